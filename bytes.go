@@ -1,6 +1,10 @@
 package websocket
 
-import "sync"
+import (
+	"bufio"
+	"io"
+	"sync"
+)
 
 var bytePool = sync.Pool{
 	New: func() interface{} {
@@ -17,3 +21,61 @@ func extendByteSlice(b []byte, needLen int) []byte {
 
 	return b[:needLen]
 }
+
+// writeBufferPool pools the buffers the batches of frames are copied into.
+var writeBufferPool sync.Pool
+
+const (
+	// minWriteBuffer is the initial capacity of the write buffers.
+	minWriteBuffer = 4096
+	// maxPooledWriteBuffer is the max capacity of the write buffers kept by the pool.
+	maxPooledWriteBuffer = 1 << 18
+)
+
+func acquireWriteBuffer() *[]byte {
+	if b, ok := writeBufferPool.Get().(*[]byte); ok {
+		return b
+	}
+
+	b := make([]byte, 0, minWriteBuffer)
+
+	return &b
+}
+
+func releaseWriteBuffer(b *[]byte) {
+	if cap(*b) > maxPooledWriteBuffer {
+		return
+	}
+
+	*b = (*b)[:0]
+	writeBufferPool.Put(b)
+}
+
+// readerPools pools the bufio readers by size.
+var readerPools sync.Map
+
+func bufferPool(pools *sync.Map, size int) *sync.Pool {
+	if p, ok := pools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+
+	p, _ := pools.LoadOrStore(size, &sync.Pool{})
+
+	return p.(*sync.Pool)
+}
+
+func acquireReader(r io.Reader, size int) *bufio.Reader {
+	br, ok := bufferPool(&readerPools, size).Get().(*bufio.Reader)
+	if !ok {
+		return bufio.NewReaderSize(r, size)
+	}
+
+	br.Reset(r)
+
+	return br
+}
+
+func releaseReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufferPool(&readerPools, br.Size()).Put(br)
+}
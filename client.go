@@ -3,10 +3,14 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -19,12 +23,12 @@ var ErrCannotUpgrade = errors.New("cannot upgrade connection")
 //
 // url must be a complete URL format i.e. http://localhost:8080/ws
 func MakeClient(c net.Conn, url string) (*Client, error) {
-	return client(c, url, nil)
+	return client(c, url, nil, nil)
 }
 
 // ClientWithHeaders returns a Conn using an existing connection and sending custom headers.
 func ClientWithHeaders(c net.Conn, url string, req *fasthttp.Request) (*Client, error) {
-	return client(c, url, req)
+	return client(c, url, req, nil)
 }
 
 // UpgradeAsClient will upgrade the connection as a client
@@ -34,6 +38,15 @@ func ClientWithHeaders(c net.Conn, url string, req *fasthttp.Request) (*Client,
 //
 // r can be nil.
 func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
+	return (&Dialer{}).UpgradeAsClient(c, url, r)
+}
+
+// upgradeAsClient performs the client handshake over br and bw.
+//
+// br might contain frames sent by the server right after the handshake response.
+// It returns the subprotocol selected by the server.
+// The handshake is traced if tr is not nil.
+func upgradeAsClient(br *bufio.Reader, bw *bufio.Writer, url string, r *fasthttp.Request, tr Tracer) (proto string, err error) {
 	req := fasthttp.AcquireRequest()
 	res := fasthttp.AcquireResponse()
 	uri := fasthttp.AcquireURI()
@@ -61,6 +74,16 @@ func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
 		r.CopyTo(req)
 	}
 
+	if tr != nil {
+		ctx, span := startHandshake(tr, context.Background(), RoleClient)
+		tr.Inject(ctx, requestHeaderCarrier{&req.Header})
+
+		defer func() {
+			span.SetAttribute(AttrSubprotocol, proto)
+			endSpan(span, err)
+		}()
+	}
+
 	req.Header.SetMethod("GET")
 	req.Header.AddBytesKV(originString, origin)
 	req.Header.AddBytesKV(connectionString, upgradeString)
@@ -72,29 +95,32 @@ func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
 	req.Header.SetHostBytes(uri.Host())
 	req.SetRequestURIBytes(uri.FullURI())
 
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
 	req.Write(bw)
 	bw.Flush()
 
-	err := res.Read(br)
+	err = res.Read(br)
 	if err == nil {
 		if res.StatusCode() != 101 ||
 			!equalsFold(res.Header.PeekBytes(upgradeString), websocketString) {
 			err = ErrCannotUpgrade
+		} else {
+			proto = string(res.Header.PeekBytes(wsHeaderProtocol))
 		}
 	}
 
-	return err
+	return proto, err
 }
 
-func client(c net.Conn, url string, r *fasthttp.Request) (cl *Client, err error) {
-	err = UpgradeAsClient(c, url, r)
+func client(c net.Conn, url string, r *fasthttp.Request, tr Tracer) (cl *Client, err error) {
+	brw := bufio.NewReadWriter(
+		bufio.NewReader(c), bufio.NewWriter(c))
+
+	proto, err := upgradeAsClient(brw.Reader, brw.Writer, url, r, tr)
 	if err == nil {
 		cl = &Client{
-			c: c,
-			brw: bufio.NewReadWriter(
-				bufio.NewReader(c), bufio.NewWriter(c)),
+			c:     c,
+			brw:   brw,
+			proto: proto,
 		}
 	}
 
@@ -111,13 +137,13 @@ func Dial(url string) (*Client, error) {
 		MaxVersion:         tls.VersionTLS13,
 	}
 
-	return dial(url, cnf, nil)
+	return dial(url, cnf, nil, nil)
 }
 
 // DialTLS establishes a websocket connection as client with the
 // tls.Config. The config will be used if the URL is wss:// like.
 func DialTLS(url string, cnf *tls.Config) (*Client, error) {
-	return dial(url, cnf, nil)
+	return dial(url, cnf, nil, nil)
 }
 
 // DialWithHeaders establishes a websocket connection as client sending a personalized request.
@@ -127,10 +153,54 @@ func DialWithHeaders(url string, req *fasthttp.Request) (*Client, error) {
 		MinVersion:         tls.VersionTLS12,
 	}
 
-	return dial(url, cnf, req)
+	return dial(url, cnf, req, nil)
+}
+
+// Dialer establishes websocket connections as client.
+//
+// The zero Dialer is ready to use.
+type Dialer struct {
+	// TLSConfig is used if the URL is wss:// like.
+	//
+	// If nil, a default config requiring TLS 1.2 at least is used.
+	TLSConfig *tls.Config
+
+	// Tracer traces the handshakes injecting the trace context
+	// into the request headers.
+	//
+	// The handshakes are not traced if Tracer is nil.
+	Tracer Tracer
+}
+
+// Dial establishes a websocket connection as client.
+//
+// req can be nil, otherwise its headers are sent within the handshake.
+func (d *Dialer) Dial(url string, req *fasthttp.Request) (*Client, error) {
+	cnf := d.TLSConfig
+	if cnf == nil {
+		cnf = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return dial(url, cnf, req, d.Tracer)
 }
 
-func dial(url string, cnf *tls.Config, req *fasthttp.Request) (conn *Client, err error) {
+// Client returns a Client using an existing connection.
+//
+// req can be nil, otherwise its headers are sent within the handshake.
+func (d *Dialer) Client(c net.Conn, url string, req *fasthttp.Request) (*Client, error) {
+	return client(c, url, req, d.Tracer)
+}
+
+// UpgradeAsClient upgrades the connection as UpgradeAsClient does,
+// tracing the handshake using Tracer.
+func (d *Dialer) UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
+	_, err := upgradeAsClient(bufio.NewReader(c), bufio.NewWriter(c), url, r, d.Tracer)
+	return err
+}
+
+func dial(url string, cnf *tls.Config, req *fasthttp.Request, tr Tracer) (conn *Client, err error) {
 	uri := fasthttp.AcquireURI()
 	defer fasthttp.ReleaseURI(uri)
 
@@ -165,7 +235,7 @@ func dial(url string, cnf *tls.Config, req *fasthttp.Request) (conn *Client, err
 	}
 
 	if err == nil {
-		conn, err = client(c, uri.String(), req)
+		conn, err = client(c, uri.String(), req, tr)
 		if err != nil {
 			c.Close()
 		}
@@ -182,11 +252,53 @@ func makeRandKey(b []byte) []byte {
 
 // Client holds a WebSocket connection.
 //
-// The client is NOT concurrently safe. It is intended to be
-// used with the Frame struct.
+// The writes are safe for concurrent use: frames written concurrently
+// are serialised and flushed together. Close can be called from any goroutine.
+// The reads are NOT concurrently safe, only one goroutine must read at a time.
 type Client struct {
-	c   net.Conn
-	brw *bufio.ReadWriter
+	c     net.Conn
+	brw   *bufio.ReadWriter
+	proto string
+
+	// mu serialises the writes on brw.
+	mu sync.Mutex
+	// msgMu prevents data frames from interleaving with fragmented messages.
+	msgMu sync.Mutex
+	// pending is the number of writers waiting for mu.
+	pending int32
+	closed  int32
+
+	// FragmentSize is the max payload size of the frames written by NextWriter.
+	//
+	// By default FragmentSize is DefaultFragmentSize.
+	FragmentSize int
+
+	// Metrics collects the metrics of the connection if defined.
+	//
+	// Only the frames, the writes and the errors are reported.
+	Metrics Metrics
+
+	pingHandler func(data []byte)
+	pongHandler func(data []byte)
+}
+
+// Subprotocol returns the subprotocol selected by the server during the handshake.
+func (c *Client) Subprotocol() string {
+	return c.proto
+}
+
+// HandlePing sets a callback for handling the data of the ping frames
+// received by ReadMessage.
+//
+// ReadMessage replies to the ping frames, thus the handler MUST not reply.
+func (c *Client) HandlePing(pingHandler func(data []byte)) {
+	c.pingHandler = pingHandler
+}
+
+// HandlePong sets a callback for handling the data of the pong frames
+// received by ReadMessage.
+func (c *Client) HandlePong(pongHandler func(data []byte)) {
+	c.pongHandler = pongHandler
 }
 
 // Write writes the content `b` as text.
@@ -219,32 +331,331 @@ func (c *Client) WriteBinary(b []byte) (int, error) {
 	return c.WriteFrame(fr)
 }
 
+// NextWriter returns a writer sending a message of type code.
+//
+// The written data is sent in frames of FragmentSize bytes,
+// the last frame is sent when closing the writer.
+// Control frames can be sent while the message is being written,
+// but no other data frame can be sent until the writer is closed.
+//
+// Other goroutines writing data frames are blocked until the writer is closed
+// or fails writing a frame, thus the writer MUST be closed.
+func (c *Client) NextWriter(code Code) io.WriteCloser {
+	c.msgMu.Lock()
+
+	fr := AcquireFrame()
+	fr.SetCode(code)
+
+	return &messageWriter{
+		fr:   fr,
+		size: c.FragmentSize,
+		flush: func(fr *Frame) (*Frame, error) {
+			fr.Mask()
+
+			_, err := c.writeFrame(fr)
+			if err != nil {
+				ReleaseFrame(fr)
+				return nil, err
+			}
+
+			fr.Reset()
+
+			return fr, nil
+		},
+		release: c.msgMu.Unlock,
+	}
+}
+
 // WriteFrame writes the frame into the WebSocket connection.
+//
+// WriteFrame is safe for concurrent use. The frames written concurrently
+// are flushed together, thus a flush error might be reported by
+// the last writer only.
 func (c *Client) WriteFrame(fr *Frame) (int, error) {
-	nn, err := fr.WriteTo(c.brw)
-	if err == nil {
-		err = c.brw.Flush()
+	if !fr.IsControl() {
+		c.msgMu.Lock()
+		defer c.msgMu.Unlock()
+	}
+
+	return c.writeFrame(fr)
+}
+
+func (c *Client) writeFrame(fr *Frame) (int, error) {
+	atomic.AddInt32(&c.pending, 1)
+	c.mu.Lock()
+	atomic.AddInt32(&c.pending, -1)
+	defer c.mu.Unlock()
+
+	var start time.Time
+	if c.Metrics != nil {
+		start = time.Now()
+	}
+
+	var nn int64
+
+	err := net.ErrClosed
+	if atomic.LoadInt32(&c.closed) == 0 {
+		nn, err = fr.WriteTo(c.brw)
+	}
+
+	// the waiting writers will flush this frame along with theirs,
+	// the last one flushes the frames buffered even if its own failed.
+	if atomic.LoadInt32(&c.pending) == 0 && c.brw.Writer.Buffered() > 0 {
+		if ferr := c.brw.Flush(); err == nil {
+			err = ferr
+		}
+	}
+
+	if err == net.ErrClosed {
+		return 0, err
+	}
+
+	if c.Metrics != nil {
+		if err != nil {
+			c.Metrics.Error(err)
+		} else {
+			c.Metrics.FrameWritten(fr.Code(), int(nn))
+			c.Metrics.WriteDone(int(atomic.LoadInt32(&c.pending)), time.Since(start))
+		}
 	}
 
 	return int(nn), err
 }
 
 // ReadFrame reads a frame from the connection.
+//
+// The frames breaking the protocol rules checked by Frame.Validate,
+// except the masking, are read returning the validation error.
 func (c *Client) ReadFrame(fr *Frame) (int, error) {
+	n, _, err := c.readFrame(fr)
+
+	return n, err
+}
+
+// readFrame reads a frame reporting whether it breaks the protocol rules.
+func (c *Client) readFrame(fr *Frame) (int, bool, error) {
 	n, err := fr.ReadFrom(c.brw)
-	return int(n), err
+
+	invalid := false
+	if err == nil {
+		err = fr.validate()
+		invalid = err != nil
+	}
+
+	if c.Metrics != nil {
+		switch {
+		case err == nil:
+			c.Metrics.FrameRead(fr.Code(), fr.wireSize())
+		case atomic.LoadInt32(&c.closed) == 0:
+			c.Metrics.Error(err)
+		}
+	}
+
+	return int(n), invalid, err
+}
+
+// failFrame fails the connection on an invalid frame (RFC 6455 section 7.1.7)
+// returning the validation error.
+func (c *Client) failFrame(err error) error {
+	c.CloseDetail(StatusProtocolError, err.Error())
+
+	return err
+}
+
+// ReadMessage reads a data message appending its payload to dst.
+//
+// The fragmented messages are reassembled and the control frames are handled
+// replying to the pings. If the peer closes the connection,
+// the returned error is an Error holding the status and the reason.
+func (c *Client) ReadMessage(dst []byte) (Code, []byte, error) {
+	var code Code
+
+	started := false
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for {
+		fr.Reset()
+
+		_, invalid, err := c.readFrame(fr)
+		if invalid {
+			err = c.failFrame(err)
+		}
+		if err != nil {
+			return code, dst, err
+		}
+
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		if fr.IsControl() {
+			if err = c.handleControl(fr); err != nil {
+				return code, dst, err
+			}
+
+			continue
+		}
+
+		switch {
+		case !started && fr.IsContinuation():
+			return code, dst, errUnexpectedContinuation
+		case started && !fr.IsContinuation():
+			return code, dst, errExpectedContinuation
+		case !started:
+			code, started = fr.Code(), true
+		}
+
+		dst = append(dst, fr.Payload()...)
+
+		if fr.IsFin() {
+			return code, dst, nil
+		}
+	}
+}
+
+// NextReader returns the next data message received from the peer.
+// The returned reader spans all the frames of the message.
+//
+// The control frames are handled like ReadMessage does.
+// The reader is invalidated by the next call to NextReader or ReadMessage.
+func (c *Client) NextReader() (Code, io.Reader, error) {
+	fr, err := c.nextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if fr.IsContinuation() {
+		ReleaseFrame(fr)
+		return 0, nil, errUnexpectedContinuation
+	}
+
+	mr := &messageReader{
+		fr: fr,
+		next: func() (*Frame, error) {
+			fr, err := c.nextFrame()
+			if err == nil && !fr.IsContinuation() {
+				ReleaseFrame(fr)
+				return nil, errExpectedContinuation
+			}
+
+			return fr, err
+		},
+	}
+
+	return fr.Code(), mr, nil
+}
+
+// nextFrame returns the next data frame handling the control frames.
+func (c *Client) nextFrame() (*Frame, error) {
+	fr := AcquireFrame()
+
+	for {
+		fr.Reset()
+
+		_, invalid, err := c.readFrame(fr)
+		if invalid {
+			err = c.failFrame(err)
+		}
+		if err == nil {
+			if fr.IsMasked() {
+				fr.Unmask()
+			}
+
+			if !fr.IsControl() {
+				return fr, nil
+			}
+
+			err = c.handleControl(fr)
+		}
+
+		if err != nil {
+			ReleaseFrame(fr)
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) handleControl(fr *Frame) error {
+	switch {
+	case fr.IsPing():
+		if c.pingHandler != nil {
+			c.pingHandler(fr.Payload())
+		}
+
+		pong := AcquireFrame()
+		defer ReleaseFrame(pong)
+
+		pong.SetPong()
+		pong.SetFin()
+		pong.SetPayload(fr.Payload())
+		pong.Mask()
+
+		_, err := c.WriteFrame(pong)
+
+		return err
+	case fr.IsPong():
+		if c.pongHandler != nil {
+			c.pongHandler(fr.Payload())
+		}
+	case fr.IsClose():
+		if fr.PayloadLen() == 1 {
+			return c.failFrame(ErrInvalidClosePayload)
+		}
+
+		// the reason follows the status, if any
+		err := Error{Status: fr.Status()}
+		if err.Status != StatusNone {
+			err.Reason = string(fr.Payload())
+		}
+
+		// reply back closing the client, unless it was closed already
+		c.CloseDetail(err.Status, "")
+
+		return err
+	}
+
+	return nil
 }
 
 // Close gracefully closes the websocket connection.
+//
+// Close can be called while another goroutine is reading or writing.
 func (c *Client) Close() error {
+	return c.CloseDetail(StatusNone, "")
+}
+
+// CloseDetail closes the connection sending the status and the reason to the server.
+func (c *Client) CloseDetail(status StatusCode, reason string) error {
 	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
 	fr.SetClose()
 	fr.SetFin()
 
-	fr.SetStatus(StatusNone)
+	fr.SetStatus(status)
+	io.WriteString(fr, reason)
+	fr.Mask()
+
+	c.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.mu.Unlock()
+		return nil
+	}
+
+	n, err := fr.WriteTo(c.brw)
+	if err == nil {
+		err = c.brw.Flush()
+	}
+	c.mu.Unlock()
+
+	if err == nil && c.Metrics != nil {
+		c.Metrics.FrameWritten(CodeClose, int(n))
+	}
 
-	_, err := c.WriteFrame(fr)
 	if err != nil {
+		c.c.Close()
 		return err
 	}
 
@@ -255,6 +666,8 @@ func (c *Client) Close() error {
 
 // Shutdown closes the websocket connection immediately.
 func (c *Client) Shutdown() error {
+	atomic.StoreInt32(&c.closed, 1)
+
 	c.c.SetDeadline(time.Unix(1, 0))
 
 	return c.c.Close()
@@ -1,8 +1,15 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,9 +39,9 @@ func TestDial(t *testing.T) {
 		}
 	})
 
-	ws.HandleClose(func(c *Conn, err error) {
-		if err != nil && err.(Error).Status != StatusGoAway {
-			t.Fatalf("Expected GoAway, got %s", err.(Error).Status)
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		if info.Err == nil && info.Status != StatusGoAway {
+			t.Fatalf("Expected GoAway, got %s", info.Status)
 		}
 	})
 
@@ -76,3 +83,397 @@ func TestDial(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestClientBufferedFrames(t *testing.T) {
+	text := []byte("sent with the handshake")
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		var req fasthttp.Request
+		if err := req.Read(bufio.NewReader(c)); err != nil {
+			c.Close()
+			return
+		}
+
+		var bf bytes.Buffer
+		bf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Accept: " + string(makeKey(nil, req.Header.PeekBytes(wsHeaderKey))) + "\r\n\r\n")
+
+		fr := AcquireFrame()
+		fr.SetText()
+		fr.SetFin()
+		fr.SetPayload(text)
+		fr.WriteTo(&bf)
+		ReleaseFrame(fr)
+
+		// the response and the frame are written at once
+		c.Write(bf.Bytes())
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err = conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fr.Payload(), text) {
+		t.Fatalf("%s <> %s", fr.Payload(), text)
+	}
+}
+
+func TestClientNextWriter(t *testing.T) {
+	text := strings.Repeat("fragmented payload ", 100)
+	ch := make(chan string, 1)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ws := Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.FragmentSize = 64
+
+	w := conn.NextWriter(CodeText)
+	for i := 0; i < len(text); i += 100 {
+		if _, err := io.WriteString(w, text[i:i+100]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-ch:
+		if data != text {
+			t.Fatalf("%s <> %s", data, text)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestClientNextWriterError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := &Client{
+		c:   c1,
+		brw: bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)),
+	}
+	conn.FragmentSize = 4
+
+	// the peer is gone before the message is complete
+	c1.Close()
+
+	w := conn.NextWriter(CodeText)
+	if _, err := io.WriteString(w, "fragmented"); err == nil {
+		t.Fatal("expected write error")
+	}
+
+	// the failed writer does not block the other writers
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("next"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected write error")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if err := w.Close(); err == nil {
+		t.Fatal("expected close error")
+	}
+}
+
+func TestClientFlushPending(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := &Client{
+		c:   c1,
+		brw: bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)),
+	}
+
+	// a writer waiting for the lock leaves the flush to it
+	atomic.AddInt32(&conn.pending, 1)
+	if _, err := conn.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt32(&conn.pending, -1)
+
+	read := make(chan []byte, 1)
+	go func() {
+		fr := AcquireFrame()
+		defer ReleaseFrame(fr)
+
+		c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+		fr.ReadFrom(c2)
+		fr.Unmask()
+
+		read <- append([]byte(nil), fr.Payload()...)
+	}()
+
+	// the waiting writer finds the client closed but flushes the pending frame
+	atomic.StoreInt32(&conn.closed, 1)
+	if _, err := conn.Write([]byte("second")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if b := <-read; string(b) != "first" {
+		t.Fatalf("unexpected payload: %q", b)
+	}
+}
+
+func TestClientReadInvalidClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := &Client{
+		c:   c1,
+		brw: bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)),
+	}
+
+	status := make(chan StatusCode, 1)
+	go func() {
+		// a close frame holding 1 byte
+		c2.Write([]byte{0x88, 0x01, 'x'})
+
+		fr := AcquireFrame()
+		defer ReleaseFrame(fr)
+
+		c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+		fr.ReadFrom(c2)
+		fr.Unmask()
+
+		status <- fr.Status()
+	}()
+
+	if _, _, err := conn.ReadMessage(nil); !errors.Is(err, ErrInvalidClosePayload) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if s := <-status; s != StatusProtocolError {
+		t.Fatalf("unexpected status: %s", s)
+	}
+
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClientReadMessage(t *testing.T) {
+	pong := make(chan string, 1)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		c.FragmentSize = 5
+
+		w := c.NextWriter(CodeText)
+		io.WriteString(w, "Hello ")
+		c.Ping([]byte("ping"))
+		io.WriteString(w, "world")
+		w.Close()
+	})
+	ws.HandlePong(func(c *Conn, data []byte) {
+		pong <- string(data)
+
+		c.CloseDetail(StatusGoAway, "bye")
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	ping := ""
+	conn.HandlePing(func(data []byte) {
+		ping = string(data)
+	})
+
+	code, b, err := conn.ReadMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != CodeText || string(b) != "Hello world" {
+		t.Fatalf("unexpected message %s: %s", code, b)
+	}
+	if ping != "ping" {
+		t.Fatalf("unexpected ping: %s", ping)
+	}
+
+	select {
+	case data := <-pong:
+		if data != "ping" {
+			t.Fatalf("unexpected pong: %s", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	_, _, err = conn.ReadMessage(b[:0])
+	if e, ok := err.(Error); !ok || e.Status != StatusGoAway || e.Reason != "bye" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the client is closed once the close frame has been replied
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClientConcurrentWrites(t *testing.T) {
+	const (
+		writers  = 8
+		messages = 100
+	)
+
+	text := "concurrent message"
+	received := make(chan struct{}, writers*messages)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ws := Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) != text && string(data) != text+text {
+			t.Errorf("unexpected message: %s", data)
+		}
+
+		received <- struct{}{}
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.FragmentSize = 4
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < messages; j++ {
+				var err error
+
+				// fragmented messages must not interleave with other data frames
+				if i%2 == 0 {
+					w := conn.NextWriter(CodeText)
+					io.WriteString(w, text)
+					io.WriteString(w, text)
+					err = w.Close()
+				} else {
+					_, err = io.WriteString(conn, text)
+				}
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage(nil)
+		readErr <- err
+	}()
+
+	wg.Wait()
+
+	for i := 0; i < writers*messages; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout after %d messages", i)
+		}
+	}
+
+	// closing while reading
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("expected read error")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if _, err := conn.Write([]byte(text)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
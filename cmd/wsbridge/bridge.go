@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/xenking/websocket"
+)
+
+// Subprotocols supported by the bridge.
+//
+// Using protoBinary the data is sent as binary messages,
+// using protoBase64 the data is sent base64 encoded as text messages.
+const (
+	protoBinary = "binary"
+	protoBase64 = "base64"
+)
+
+const (
+	backendKey  = "wsbridge.backend"
+	dialTimeout = time.Second * 10
+	bufferSize  = 32 << 10
+)
+
+var errTooManyConns = errors.New("too many connections")
+
+// limiter limits the number of connections being bridged.
+//
+// A nil limiter doesn't limit the connections.
+type limiter chan struct{}
+
+func newLimiter(max int) limiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return make(limiter, max)
+}
+
+func (l limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+func (l limiter) full() bool {
+	return l != nil && len(l) == cap(l)
+}
+
+// wsBridge bridges the WebSocket connections upgraded by the Server to a TCP backend.
+type wsBridge struct {
+	backend string
+	limit   limiter
+	log     *log.Logger
+}
+
+func newWSBridge(backend string, maxConns int, logger *log.Logger) *wsBridge {
+	return &wsBridge{
+		backend: backend,
+		limit:   newLimiter(maxConns),
+		log:     logger,
+	}
+}
+
+// server returns the websocket.Server bridging the connections.
+func (b *wsBridge) server() *websocket.Server {
+	ws := &websocket.Server{
+		Protocols: []string{protoBinary, protoBase64},
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			if b.limit.full() {
+				b.log.Printf("%s rejected: %s", ctx.RemoteAddr(), errTooManyConns)
+				ctx.Error(errTooManyConns.Error(), fasthttp.StatusServiceUnavailable)
+
+				return false
+			}
+
+			return true
+		},
+	}
+
+	ws.HandleOpen(b.open)
+	ws.HandleData(b.data)
+	ws.HandleClose(b.close)
+
+	return ws
+}
+
+func (b *wsBridge) open(c *websocket.Conn) {
+	// the limit might be reached between the upgrade and here
+	if !b.limit.acquire() {
+		b.log.Printf("%s rejected: %s", c.RemoteAddr(), errTooManyConns)
+		c.CloseDetail(websocket.StatusViolation, errTooManyConns.Error())
+
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", b.backend, dialTimeout)
+	if err != nil {
+		b.limit.release()
+		b.log.Printf("%s cannot reach backend: %s", c.RemoteAddr(), err)
+		c.CloseDetail(websocket.StatusUnexpected, "backend unavailable")
+
+		return
+	}
+
+	c.SetUserValue(backendKey, backend)
+
+	b.log.Printf("%s bridged to %s (%s)", c.RemoteAddr(), b.backend, protocol(c.Subprotocol()))
+
+	go b.pump(c, backend)
+}
+
+// pump sends the data received from the backend to the WebSocket peer.
+func (b *wsBridge) pump(c *websocket.Conn, backend net.Conn) {
+	isBase64 := c.Subprotocol() == protoBase64
+
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := backend.Read(buf)
+		if n > 0 {
+			fr := websocket.AcquireFrame()
+			fr.SetFin()
+			if isBase64 {
+				fr.SetText()
+				fr.SetPayload(encodeBase64(buf[:n]))
+			} else {
+				fr.SetBinary()
+				fr.SetPayload(buf[:n])
+			}
+
+			c.WriteFrame(fr)
+		}
+
+		if err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+func (b *wsBridge) data(c *websocket.Conn, isBinary bool, data []byte) {
+	backend, ok := c.UserValue(backendKey).(net.Conn)
+	if !ok {
+		return
+	}
+
+	if c.Subprotocol() == protoBase64 {
+		var err error
+		if data, err = decodeBase64(data); err != nil {
+			b.log.Printf("%s sent invalid data: %s", c.RemoteAddr(), err)
+			c.CloseDetail(websocket.StatusNotConsistent, "invalid base64 data")
+
+			return
+		}
+	}
+
+	if _, err := backend.Write(data); err != nil {
+		b.log.Printf("%s cannot write to backend: %s", c.RemoteAddr(), err)
+		c.CloseDetail(websocket.StatusUnexpected, "backend closed")
+	}
+}
+
+func (b *wsBridge) close(c *websocket.Conn, info websocket.CloseInfo) {
+	backend, ok := c.UserValue(backendKey).(net.Conn)
+	if !ok {
+		return
+	}
+
+	backend.Close()
+	b.limit.release()
+
+	switch {
+	case info.Err != nil:
+		b.log.Printf("%s closed after %s: %s", c.RemoteAddr(), info.Duration, info.Err)
+	case info.Remote:
+		b.log.Printf("%s closed after %s: %s", c.RemoteAddr(), info.Duration, info.Status)
+	default:
+		b.log.Printf("%s closed by the bridge after %s: %s", c.RemoteAddr(), info.Duration, info.Status)
+	}
+}
+
+// tcpBridge bridges the accepted TCP connections to a remote WebSocket server.
+type tcpBridge struct {
+	url   string
+	proto string
+	limit limiter
+	log   *log.Logger
+}
+
+func newTCPBridge(url, proto string, maxConns int, logger *log.Logger) *tcpBridge {
+	return &tcpBridge{
+		url:   url,
+		proto: proto,
+		limit: newLimiter(maxConns),
+		log:   logger,
+	}
+}
+
+// serve bridges the connections accepted by ln until ln is closed.
+func (b *tcpBridge) serve(ln net.Listener) error {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		if !b.limit.acquire() {
+			b.log.Printf("%s rejected: %s", nc.RemoteAddr(), errTooManyConns)
+			nc.Close()
+
+			continue
+		}
+
+		go func() {
+			defer b.limit.release()
+
+			b.bridge(nc)
+		}()
+	}
+}
+
+func (b *tcpBridge) bridge(nc net.Conn) {
+	defer nc.Close()
+
+	req := fasthttp.AcquireRequest()
+	req.Header.Set("Sec-WebSocket-Protocol", b.proto)
+
+	c, err := websocket.DialWithHeaders(b.url, req)
+	fasthttp.ReleaseRequest(req)
+	if err != nil {
+		b.log.Printf("%s cannot reach %s: %s", nc.RemoteAddr(), b.url, err)
+		return
+	}
+	defer c.Close()
+
+	// the server might not support the subprotocol requested
+	isBase64 := c.Subprotocol() == protoBase64
+
+	b.log.Printf("%s bridged to %s (%s)", nc.RemoteAddr(), b.url, protocol(c.Subprotocol()))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		// unblock the writer side once the peer stops sending
+		defer nc.Close()
+
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+
+			if isBase64 {
+				r = base64.NewDecoder(base64.StdEncoding, r)
+			}
+
+			if _, err = io.Copy(nc, r); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := nc.Read(buf)
+		if n > 0 {
+			if isBase64 {
+				_, werr := c.Write(encodeBase64(buf[:n]))
+				err = firstError(err, werr)
+			} else {
+				_, werr := c.WriteBinary(buf[:n])
+				err = firstError(err, werr)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	c.Close()
+	wg.Wait()
+
+	b.log.Printf("%s closed", nc.RemoteAddr())
+}
+
+func firstError(err, other error) error {
+	if err != nil {
+		return err
+	}
+
+	return other
+}
+
+// protocol returns the name of the subprotocol used to bridge the data.
+func protocol(proto string) string {
+	if proto == "" {
+		return protoBinary
+	}
+
+	return proto
+}
+
+func encodeBase64(b []byte) []byte {
+	dst := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(dst, b)
+
+	return dst
+}
+
+func decodeBase64(b []byte) ([]byte, error) {
+	dst := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(dst, b)
+
+	return dst[:n], err
+}
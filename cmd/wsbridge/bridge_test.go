@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/xenking/websocket"
+)
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	return ln
+}
+
+// serveEcho runs a TCP echo server returning its address.
+func serveEcho(t *testing.T) string {
+	ln := listen(t)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// serveWSBridge runs a wsBridge to backend returning its URL.
+func serveWSBridge(t *testing.T, backend string, maxConns int) string {
+	ln := listen(t)
+
+	s := fasthttp.Server{
+		Handler: newWSBridge(backend, maxConns, discardLogger).server().Upgrade,
+	}
+	go s.Serve(ln)
+
+	return "ws://" + ln.Addr().String() + "/"
+}
+
+func testBridge(t *testing.T, proto string) {
+	wsURL := serveWSBridge(t, serveEcho(t), 0)
+
+	ln := listen(t)
+	go newTCPBridge(wsURL, proto, 0, discardLogger).serve(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+
+	payload := bytes.Repeat([]byte("bridged\x00\xff"), 10000)
+	go c.Write(payload)
+
+	b := make([]byte, len(payload))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatal("unexpected payload")
+	}
+}
+
+func TestBridgeBinary(t *testing.T) {
+	testBridge(t, protoBinary)
+}
+
+func TestBridgeBase64(t *testing.T) {
+	testBridge(t, protoBase64)
+}
+
+func TestBridgeSubprotocol(t *testing.T) {
+	wsURL := serveWSBridge(t, serveEcho(t), 0)
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.Set("Sec-WebSocket-Protocol", protoBase64)
+
+	c, err := websocket.DialWithHeaders(wsURL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if p := c.Subprotocol(); p != protoBase64 {
+		t.Fatalf("unexpected subprotocol: %s", p)
+	}
+
+	if _, err := c.Write([]byte("aGVsbG8=")); err != nil {
+		t.Fatal(err)
+	}
+
+	code, b, err := c.ReadMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != websocket.CodeText || string(b) != "aGVsbG8=" {
+		t.Fatalf("unexpected message %s: %s", code, b)
+	}
+}
+
+func TestBridgeMaxConns(t *testing.T) {
+	wsURL := serveWSBridge(t, serveEcho(t), 1)
+
+	c, err := websocket.Dial(wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the connection to be bridged
+	if _, err := c.WriteBinary([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := websocket.Dial(wsURL); !errors.Is(err, websocket.ErrCannotUpgrade) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Close()
+
+	// the connection is released once closed
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		c, err = websocket.Dial(wsURL)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,63 @@
+// Command wsbridge bridges WebSocket connections and TCP connections.
+//
+// Listening for WebSocket connections and bridging them to a TCP backend:
+//
+//	wsbridge -listen :8080 -backend localhost:5900
+//
+// Listening for TCP connections and bridging them to a WebSocket server:
+//
+//	wsbridge -tcp-listen :5900 -url ws://localhost:8080/ -protocol base64
+//
+// The data is sent as binary messages or, if the base64 subprotocol
+// is negotiated, base64 encoded as text messages.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/valyala/fasthttp"
+)
+
+func main() {
+	var (
+		listen    = flag.String("listen", "", "address listening for WebSocket connections")
+		backend   = flag.String("backend", "", "TCP address the WebSocket connections are bridged to")
+		tcpListen = flag.String("tcp-listen", "", "address listening for TCP connections")
+		url       = flag.String("url", "", "WebSocket URL the TCP connections are bridged to")
+		proto     = flag.String("protocol", protoBinary, "subprotocol requested to the WebSocket server: binary or base64")
+		maxConns  = flag.Int("max-conns", 0, "max number of connections bridged at once, 0 means unlimited")
+	)
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "wsbridge: ", log.LstdFlags)
+
+	switch {
+	case *listen != "" && *backend != "" && *tcpListen == "":
+		ws := newWSBridge(*backend, *maxConns, logger).server()
+
+		s := fasthttp.Server{
+			Handler: ws.Upgrade,
+		}
+
+		logger.Printf("bridging ws://%s to %s", *listen, *backend)
+		logger.Fatal(s.ListenAndServe(*listen))
+	case *tcpListen != "" && *url != "" && *listen == "":
+		if *proto != protoBinary && *proto != protoBase64 {
+			logger.Fatalf("unsupported subprotocol: %s", *proto)
+		}
+
+		ln, err := net.Listen("tcp", *tcpListen)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		logger.Printf("bridging tcp://%s to %s", ln.Addr(), *url)
+		logger.Fatal(newTCPBridge(*url, *proto, *maxConns, logger).serve(ln))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -3,12 +3,16 @@ package websocket
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/valyala/fasthttp"
 	"github.com/xenking/bytebufferpool"
 )
 
@@ -16,20 +20,33 @@ import (
 //
 // This handler is compatible with io.Writer.
 type Conn struct {
-	c  net.Conn
-	br *bufio.Reader
-	bw *bufio.Writer
+	c net.Conn
 
-	input  chan *Frame
-	output chan *Frame
+	// src is read through br, which is only held while the frames are being read.
+	src connReader
+	br  *bufio.Reader
+
+	// readBufferSize is the size of the pooled read buffer, writeBufferSize
+	// is the max payload size copied into the write buffer of the batches
+	// and writeBatchSize the max number of frames written at once.
+	readBufferSize  int
+	writeBufferSize int
+	writeBatchSize  int
+
+	// connChans holds the channels recycled once the Conn is released.
+	*connChans
 	closer chan struct{}
-	errch  chan error
 
 	// buffered messages
 	buffered *bytebufferpool.ByteBuffer
 
 	id uint64
 
+	// handshake request details captured when upgrading
+	header   *fasthttp.RequestHeader
+	tlsState *tls.ConnectionState
+	proto    string
+
 	// ReadTimeout ...
 	ReadTimeout time.Duration
 
@@ -41,9 +58,47 @@ type Conn struct {
 	// By default MaxPayloadSize is DefaultPayloadSize.
 	MaxPayloadSize uint64
 
-	wg     sync.WaitGroup
+	// FragmentSize is the max payload size of the frames written by NextWriter.
+	//
+	// By default FragmentSize is DefaultFragmentSize.
+	FragmentSize int
+
+	// poll is the state of the connection in netpoll mode.
+	poll *pollConn
+
+	// metrics collects the metrics of the connection if defined.
+	metrics Metrics
+
+	// message being read using NextReader
+	reader  *messageReader
+	readErr error
+
+	// ctx is cancelled with the cause of the closure once the connection is closed.
+	// uctx is ctx exposing the user values, returned by Context.
 	ctx    context.Context
+	uctx   context.Context
+	cancel context.CancelCauseFunc
+
+	// mu guards values, session, cause and the close details.
+	mu      sync.RWMutex
+	values  map[string]interface{}
+	session interface{}
+	cause   error
+
+	// close details recorded while closing
+	info      CloseInfo
+	closeSent bool
+	closeRecv bool
+	infoDone  bool
+	started   time.Time
+
+	wg     sync.WaitGroup
 	closed int32
+
+	// gen is incremented once the Conn is released, invalidating the ConnRefs.
+	// refMu holds the release while a ConnRef is being used or a frame queued.
+	gen   uint64
+	refMu sync.RWMutex
 }
 
 // ID returns a unique identifier for the connection.
@@ -51,15 +106,266 @@ func (c *Conn) ID() uint64 {
 	return c.id
 }
 
-// UserValue returns the key associated value.
-func (c *Conn) UserValue(key string) interface{} {
-	return c.ctx.Value(key)
+// Context returns the context of the connection holding the user values.
+//
+// The context is cancelled once the connection is closed and context.Cause
+// returns why: an Error holding the close status sent by either peer
+// or the I/O error that ended the connection.
+func (c *Conn) Context() context.Context {
+	if c.uctx == nil {
+		return c.ctx
+	}
+
+	return c.uctx
+}
+
+// ErrStaleConn is returned using a ConnRef once its Conn has been reused.
+var ErrStaleConn = errors.New("connection closed and reused")
+
+// ConnRef is a reference to a Conn which fails with ErrStaleConn once
+// the Conn has been released (see Server.ReuseConns) instead of
+// discarding the frames silently.
+//
+// The zero ConnRef references no connection.
+type ConnRef struct {
+	c   *Conn
+	gen uint64
+}
+
+// Ref returns a reference to c.
+func (c *Conn) Ref() ConnRef {
+	return ConnRef{
+		c:   c,
+		gen: atomic.LoadUint64(&c.gen),
+	}
+}
+
+// Do calls fn with the referenced Conn unless it has been released.
+//
+// The Conn is not released until fn returns, thus fn must not write or
+// close the Conn, which might deadlock with the release of the Conn.
+// Use the ConnRef methods instead.
+func (r ConnRef) Do(fn func(c *Conn)) error {
+	if r.c == nil {
+		return ErrStaleConn
+	}
+
+	r.c.refMu.RLock()
+	defer r.c.refMu.RUnlock()
+
+	if atomic.LoadUint64(&r.c.gen) != r.gen {
+		return ErrStaleConn
+	}
+
+	fn(r.c)
+
+	return nil
+}
+
+// Write writes data as a text message unless the Conn has been released.
+func (r ConnRef) Write(data []byte) (n int, err error) {
+	err = r.Do(func(c *Conn) {
+		n = len(data)
+		c.writeFrameLocked(textFrame(data))
+	})
+
+	return n, err
+}
+
+// WriteFrame queues fr to be written unless the Conn has been released.
+//
+// The frame is released in any case.
+func (r ConnRef) WriteFrame(fr *Frame) error {
+	err := r.Do(func(c *Conn) {
+		c.writeFrameLocked(fr)
+	})
+	if err != nil {
+		ReleaseFrame(fr)
+	}
+
+	return err
+}
+
+// Close closes the connection unless the Conn has been released.
+func (r ConnRef) Close() error {
+	return r.Do(func(c *Conn) {
+		c.closeDetail(StatusNone, "", true)
+	})
+}
+
+// setCause records the cause of the closure unless already recorded.
+func (c *Conn) setCause(err error) {
+	c.mu.Lock()
+	if c.cause == nil {
+		c.cause = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *Conn) closeCause() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.cause == nil {
+		return net.ErrClosed
+	}
+
+	return c.cause
+}
+
+// CloseInfo describes how a connection has been closed.
+type CloseInfo struct {
+	// Status is the status of the close frame initiating the close.
+	Status StatusCode
+	// Reason is the reason of the close frame initiating the close.
+	Reason string
+	// ReplyStatus is the status of the close frame sent back, zero if none.
+	//
+	// ReplyStatus is set when the peer initiates the close. A connection closed
+	// locally is closed right after sending the close frame without waiting
+	// for the reply, thus ReplyStatus is zero unless the reply was already read.
+	ReplyStatus StatusCode
+	// Remote reports whether the peer initiated the close,
+	// either sending a close frame or dropping the connection.
+	Remote bool
+	// Handshake reports whether the closing handshake completed,
+	// that is, both peers sent a close frame.
+	//
+	// As ReplyStatus, it's usually false when the connection is closed locally.
+	Handshake bool
+	// Err is the I/O error that ended the connection
+	// if it was not closed sending a close frame.
+	Err error
+	// Duration is the time the connection has been open.
+	Duration time.Duration
+}
+
+// CloseInfo returns the details of the closure of the connection.
+//
+// The details are complete once the connection has been closed,
+// that is when the CloseHandler fires or the Context is done.
+func (c *Conn) CloseInfo() CloseInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.info
+}
+
+// recordClose records a close frame sent or received.
+func (c *Conn) recordClose(remote bool, status StatusCode, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.infoDone || c.info.Err != nil {
+		return
+	}
+
+	if remote {
+		if c.closeRecv {
+			return
+		}
+		c.closeRecv = true
+	} else {
+		if c.closeSent {
+			return
+		}
+		c.closeSent = true
+	}
+
+	if c.closeSent && c.closeRecv {
+		c.info.ReplyStatus = status
+		c.info.Handshake = true
+
+		return
+	}
+
+	c.info.Status = status
+	c.info.Reason = reason
+	c.info.Remote = remote
+}
+
+// recordError records the I/O error ending the connection
+// unless the connection was being closed already.
+func (c *Conn) recordError(remote bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.infoDone || c.info.Err != nil || c.closeSent || c.closeRecv {
+		return
+	}
+
+	c.info.Err = err
+	c.info.Remote = remote
 }
 
-// SetUserValue assigns a key to the given value
-func (c *Conn) SetUserValue(key string, value interface{}) {
-	//nolint:staticcheck
-	c.ctx = context.WithValue(c.ctx, key, value)
+// finishClose completes the close details once the connection has been closed.
+func (c *Conn) finishClose() {
+	c.mu.Lock()
+	c.info.Duration = time.Since(c.started)
+	c.infoDone = true
+	c.mu.Unlock()
+}
+
+// connContext exposes the user values of the Conn as context values
+// until the Conn is released.
+type connContext struct {
+	context.Context
+	c   *Conn
+	gen uint64
+}
+
+func (ctx connContext) Value(key interface{}) interface{} {
+	if k, ok := key.(string); ok {
+		var v interface{}
+
+		err := ConnRef{c: ctx.c, gen: ctx.gen}.Do(func(c *Conn) {
+			v = c.UserValue(k)
+		})
+		if err == nil {
+			return v
+		}
+	}
+
+	return ctx.Context.Value(key)
+}
+
+// RequestURI returns the request URI sent by the peer when upgrading.
+func (c *Conn) RequestURI() []byte {
+	if c.header == nil {
+		return nil
+	}
+
+	return c.header.RequestURI()
+}
+
+// Header returns the value of the handshake request header `key`.
+func (c *Conn) Header(key string) []byte {
+	if c.header == nil {
+		return nil
+	}
+
+	return c.header.Peek(key)
+}
+
+// Cookie returns the value of the handshake request cookie `key`.
+func (c *Conn) Cookie(key string) []byte {
+	if c.header == nil {
+		return nil
+	}
+
+	return c.header.Cookie(key)
+}
+
+// TLSConnectionState returns the TLS state of the connection.
+//
+// Returns nil if the connection was not established over TLS.
+func (c *Conn) TLSConnectionState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake.
+func (c *Conn) Subprotocol() string {
+	return c.proto
 }
 
 // LocalAddr returns local address.
@@ -72,57 +378,279 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.c.RemoteAddr()
 }
 
-func acquireConn(c net.Conn) (conn *Conn) {
-	conn = &Conn{}
-	conn.reset(c)
-	conn.wg.Add(2)
+// acquireConn returns a Conn reading the frames from r and writing them to c.
+//
+// r allows to consume the data buffered before hijacking the connection.
+//
+// The connection loops run after calling start.
+func acquireConn(c net.Conn, r io.Reader) (conn *Conn) {
+	conn = &Conn{
+		connChans: acquireConnChans(),
+	}
 
-	go conn.readLoop()
-	go conn.writeLoop()
+	conn.reset(c, r)
 
 	return conn
 }
 
+// connChans holds the channels of a Conn.
+type connChans struct {
+	input  chan *Frame
+	output chan *Frame
+	errch  chan error
+}
+
+// connChansPool holds the channels released by the servers setting ReuseConns.
+var connChansPool sync.Pool
+
+func acquireConnChans() *connChans {
+	if ch, ok := connChansPool.Get().(*connChans); ok {
+		return ch
+	}
+
+	return &connChans{
+		input:  make(chan *Frame, 128),
+		output: make(chan *Frame, 128),
+		errch:  make(chan error, 2),
+	}
+}
+
+// releaseConn recycles the channels of conn once it's closed and its goroutines have exited.
+//
+// The Conn itself is not reused, the references to conn are invalidated
+// and the frames queued afterwards are discarded.
+func releaseConn(conn *Conn) {
+	conn.refMu.Lock()
+	atomic.AddUint64(&conn.gen, 1)
+	ch := conn.connChans
+	conn.connChans = nil
+	conn.refMu.Unlock()
+
+	if conn.buffered != nil {
+		bytebufferpool.Put(conn.buffered)
+		conn.buffered = nil
+	}
+
+	for {
+		select {
+		case fr := <-ch.input:
+			ReleaseFrame(fr)
+		case fr := <-ch.output:
+			ReleaseFrame(fr)
+		case <-ch.errch:
+		default:
+			connChansPool.Put(ch)
+			return
+		}
+	}
+}
+
+// start runs the read and write loops.
+func (c *Conn) start() {
+	c.begin()
+
+	c.wg.Add(2)
+
+	go c.readLoop()
+	go c.writeLoop()
+}
+
+// begin starts the lifecycle of the connection.
+func (c *Conn) begin() {
+	// the request context might be cancelled once the request is hijacked
+	c.ctx, c.cancel = context.WithCancelCause(context.WithoutCancel(c.ctx))
+	c.uctx = connContext{
+		Context: c.ctx,
+		c:       c,
+		gen:     atomic.LoadUint64(&c.gen),
+	}
+	c.started = time.Now()
+}
+
+// netRequestHeader copies the net/http request headers
+// into a fasthttp.RequestHeader.
+func netRequestHeader(req *http.Request) *fasthttp.RequestHeader {
+	h := &fasthttp.RequestHeader{}
+
+	h.SetMethod(req.Method)
+	h.SetRequestURI(req.RequestURI)
+	h.SetHost(req.Host)
+
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+
+	return h
+}
+
 // DefaultPayloadSize defines the default payload size (when none was defined).
 const DefaultPayloadSize = 1 << 20
 
+// DefaultReadBufferSize defines the default size of the
+// buffer used to read the frames (when none was defined).
+const DefaultReadBufferSize = 4096
+
+// DefaultWriteBufferSize defines the default max payload size of the
+// frames copied into the write buffer (when none was defined).
+const DefaultWriteBufferSize = 4096
+
+// DefaultWriteBatchSize defines the default number of
+// queued frames written at once (when none was defined).
+const DefaultWriteBatchSize = 64
+
+// DefaultFragmentSize defines the default payload size of the
+// frames written by NextWriter (when none was defined).
+const DefaultFragmentSize = 1 << 15
+
 // Reset resets conn values setting c as default connection endpoint.
-func (c *Conn) reset(conn net.Conn) {
-	c.input = make(chan *Frame, 128)
-	c.output = make(chan *Frame, 128)
+func (c *Conn) reset(conn net.Conn, r io.Reader) {
 	c.closer = make(chan struct{}, 1)
-	c.errch = make(chan error, 2)
-	c.ReadTimeout = 0
-	c.WriteTimeout = 0
+
 	c.MaxPayloadSize = DefaultPayloadSize
-	c.ctx = nil
+	c.FragmentSize = DefaultFragmentSize
+	c.ctx = context.Background()
+	c.readBufferSize = DefaultReadBufferSize
+	c.writeBufferSize = DefaultWriteBufferSize
+	c.writeBatchSize = DefaultWriteBatchSize
 	c.c = conn
-	c.br = bufio.NewReader(conn)
-	c.bw = bufio.NewWriter(conn)
+	c.br = nil
+	c.src = connReader{r: conn}
+
+	if r != nil && r != io.Reader(conn) {
+		// the data buffered along with the handshake is kept apart
+		// so the buffers of the HTTP server are not read anymore
+		pending, err := drainBuffered(conn, r)
+		if err != nil {
+			c.src.r = r
+		}
+
+		c.src.pending = pending
+	}
+}
+
+// drainBuffered returns the data buffered by r without blocking.
+func drainBuffered(c net.Conn, r io.Reader) ([]byte, error) {
+	if br, ok := r.(*bufio.Reader); ok {
+		b, err := br.Peek(br.Buffered())
+
+		return append([]byte(nil), b...), err
+	}
+
+	if err := c.SetReadDeadline(aLongTimeAgo); err != nil {
+		return nil, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	var (
+		b   []byte
+		buf [512]byte
+	)
+
+	for {
+		n, err := r.Read(buf[:])
+		b = append(b, buf[:n]...)
+
+		// the deadline stops reading from c once the buffered data has been read
+		if err != nil {
+			return b, nil
+		}
+	}
+}
+
+// aLongTimeAgo is a deadline making the reads return right away.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader reads the connection returning first the pending data
+// and the byte read while waiting for the connection to be readable.
+type connReader struct {
+	r       io.Reader
+	pending []byte
+
+	peeked  [1]byte
+	npeeked int
+	err     error
+}
+
+// wait blocks until the connection is readable without holding a buffer.
+//
+// The read error, if any, is returned by the next Read.
+func (cr *connReader) wait() {
+	if cr.buffered() {
+		return
+	}
+
+	cr.npeeked, cr.err = cr.r.Read(cr.peeked[:])
+}
+
+// buffered reports whether Read returns without reading the connection.
+func (cr *connReader) buffered() bool {
+	return cr.npeeked != 0 || len(cr.pending) != 0 || cr.err != nil
+}
+
+func (cr *connReader) Read(b []byte) (int, error) {
+	switch {
+	case len(b) == 0:
+		return 0, nil
+	case cr.npeeked != 0:
+		b[0] = cr.peeked[0]
+		cr.npeeked = 0
+
+		return 1, nil
+	case len(cr.pending) != 0:
+		n := copy(b, cr.pending)
+
+		cr.pending = cr.pending[n:]
+		if len(cr.pending) == 0 {
+			cr.pending = nil
+		}
+
+		return n, nil
+	case cr.err != nil:
+		err := cr.err
+		cr.err = nil
+
+		return 0, err
+	}
+
+	return cr.r.Read(b)
 }
 
 func (c *Conn) readLoop() {
 	defer c.wg.Done()
+	defer c.releaseReader()
 
 	for {
-		fr := AcquireFrame()
-		fr.SetPayloadSize(c.MaxPayloadSize)
+		if c.br == nil {
+			c.src.wait()
+			c.br = acquireReader(&c.src, c.readBufferSize)
+		}
+
+		fr, err := c.readFrame(c.br)
+
+		// the idle connections hold no read buffer
+		if c.br.Buffered() == 0 && !c.src.buffered() {
+			c.releaseReader()
+		}
 
-		_, err := fr.ReadFrom(c.br)
 		if err != nil {
 			select {
 			case c.errch <- closeError{err: err}:
 			default:
 			}
 
-			ReleaseFrame(fr)
-
 			break
 		}
 
 		isClose := fr.IsClose()
 
-		c.input <- fr
+		select {
+		case c.input <- fr:
+		case <-c.closer:
+			ReleaseFrame(fr)
+			return
+		}
 
 		if isClose {
 			break
@@ -130,6 +658,71 @@ func (c *Conn) readLoop() {
 	}
 }
 
+func (c *Conn) releaseReader() {
+	if c.br != nil {
+		releaseReader(c.br)
+		c.br = nil
+	}
+}
+
+// readFrame reads the next frame from r recording the close frames and the I/O errors.
+func (c *Conn) readFrame(r io.Reader) (*Frame, error) {
+	fr := AcquireFrame()
+	fr.SetPayloadSize(c.MaxPayloadSize)
+
+	_, err := fr.ReadFrom(r)
+	if err != nil {
+		ReleaseFrame(fr)
+		c.readFailed(err)
+
+		return nil, err
+	}
+
+	return c.frameRead(fr)
+}
+
+// readFailed records the error reading a frame.
+func (c *Conn) readFailed(err error) {
+	// the reads failing once closed locally are expected
+	if c.metrics != nil && atomic.LoadInt32(&c.closed) == 0 {
+		c.metrics.Error(err)
+	}
+
+	c.setCause(err)
+	c.recordError(true, err)
+}
+
+// frameRead checks the frame read, which is released if invalid.
+func (c *Conn) frameRead(fr *Frame) (*Frame, error) {
+	if c.metrics != nil {
+		c.metrics.FrameRead(fr.Code(), fr.wireSize())
+	}
+
+	// the connection is failed on invalid frames (RFC 6455 section 7.1.7),
+	// the unmasked frames are still accepted.
+	if err := fr.validate(); err != nil {
+		ReleaseFrame(fr)
+
+		if c.metrics != nil {
+			c.metrics.Error(err)
+		}
+
+		c.CloseDetail(StatusProtocolError, err.Error())
+
+		return nil, err
+	}
+
+	if fr.IsClose() {
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		c.recordClose(true, fr.Status(), string(fr.Payload()))
+	}
+
+	return fr, nil
+}
+
 type closeError struct {
 	err error
 }
@@ -142,24 +735,41 @@ func (ce closeError) Error() string {
 	return ce.err.Error()
 }
 
+// unwrapCloseError returns the I/O error that closed the connection.
+func unwrapCloseError(err error) error {
+	if ce := (closeError{}); errors.As(err, &ce) {
+		return ce.err
+	}
+
+	return err
+}
+
 func (c *Conn) writeLoop() {
 	defer c.wg.Done()
 
+	// the context is cancelled once the connection has been closed
+	defer func() {
+		c.finishClose()
+		c.cancel(c.closeCause())
+	}()
+
+	// the connection is closed once the pending frames have been written
+	defer c.c.Close()
+
+	batch := make([]*Frame, 0, c.writeBatchSize)
+
 loop:
 	for {
 		select {
 		case fr := <-c.output:
-			if err := c.writeFrame(fr); err != nil {
+			isClose, err := c.writeQueued(c.nextBatch(append(batch, fr)))
+			if err != nil {
 				select {
 				case c.errch <- closeError{err}:
 				default:
 				}
 			}
 
-			isClose := fr.IsClose()
-
-			ReleaseFrame(fr)
-
 			if isClose {
 				return
 			}
@@ -169,34 +779,283 @@ loop:
 	}
 
 	// flush all the frames
-	for n := len(c.output); n >= 0; n-- {
-		fr, ok := <-c.output
-		if !ok {
-			break
+	for {
+		select {
+		case fr := <-c.output:
+			if _, err := c.writeQueued(c.nextBatch(append(batch, fr))); err != nil {
+				return
+			}
+		default:
+			return
 		}
+	}
+}
 
-		if err := c.writeFrame(fr); err != nil {
-			break
+// nextBatch appends the queued frames to batch until the batch is full,
+// no frame is queued or a close frame is found.
+func (c *Conn) nextBatch(batch []*Frame) []*Frame {
+	for len(batch) < c.writeBatchSize && !batch[len(batch)-1].IsClose() {
+		select {
+		case fr := <-c.output:
+			batch = append(batch, fr)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// writeQueued writes the frames queued by WriteFrame releasing them.
+//
+// Only the last frame of the batch can be a close frame.
+func (c *Conn) writeQueued(batch []*Frame) (isClose bool, err error) {
+	defer func() {
+		for _, fr := range batch {
+			ReleaseFrame(fr)
 		}
+		clear(batch)
+	}()
+
+	last := batch[len(batch)-1]
+	isClose = last.IsClose()
+
+	var start time.Time
+	if c.metrics != nil {
+		start = time.Now()
 	}
+
+	if err = c.writeFrames(batch); err != nil {
+		if c.metrics != nil {
+			c.metrics.Error(err)
+		}
+
+		c.setCause(err)
+		c.recordError(false, err)
+
+		return isClose, err
+	}
+
+	if c.metrics != nil {
+		c.reportWritten(batch, time.Since(start))
+	}
+
+	if isClose {
+		c.recordClose(false, last.Status(), string(last.Payload()))
+	}
+
+	return isClose, nil
 }
 
-func (c *Conn) writeFrame(fr *Frame) error {
-	fr.SetPayloadSize(c.MaxPayloadSize)
+// reportWritten reports the frames written at once to the metrics.
+func (c *Conn) reportWritten(batch []*Frame, d time.Duration) {
+	for _, fr := range batch {
+		c.metrics.FrameWritten(fr.Code(), fr.wireSize())
+	}
 
+	c.metrics.WriteDone(len(c.output), d)
+}
+
+// writeFrames writes the frames at once.
+//
+// The frames are copied into a single buffer, except the payloads larger than
+// the write buffer which are written along with it (using writev over TCP).
+func (c *Conn) writeFrames(frs []*Frame) error {
 	if c.WriteTimeout > 0 {
 		c.c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
 		defer c.c.SetWriteDeadline(time.Time{})
 	}
 
-	_, err := fr.WriteTo(c.bw)
-	if err == nil {
-		err = c.bw.Flush()
+	bp := acquireWriteBuffer()
+	defer releaseWriteBuffer(bp)
+
+	var (
+		bufs  net.Buffers
+		start int
+	)
+
+	b := *bp
+
+	for _, fr := range frs {
+		b = fr.appendHeader(b)
+
+		if len(fr.b) <= c.writeBufferSize {
+			b = append(b, fr.b...)
+			continue
+		}
+
+		bufs = append(bufs, b[start:], fr.b)
+		start = len(b)
 	}
 
+	*bp = b
+
+	if len(bufs) == 0 {
+		_, err := c.c.Write(b)
+		return err
+	}
+
+	if start < len(b) {
+		bufs = append(bufs, b[start:])
+	}
+
+	_, err := bufs.WriteTo(c.c)
+
 	return err
 }
 
+// ReadMessage reads the next data message from the connection
+// replying to the control frames.
+//
+// ReadMessage must only be used with connections returned by the Upgrader.
+func (c *Conn) ReadMessage(ctx context.Context) (Code, []byte, error) {
+	code, r, err := c.NextReader(ctx)
+	if err != nil {
+		return code, nil, err
+	}
+
+	b, err := io.ReadAll(r)
+
+	return code, b, err
+}
+
+// NextReader returns the next data message received from the peer.
+// The returned reader spans all the frames of the message.
+//
+// The reader is invalidated by the next call to NextReader or ReadMessage.
+//
+// NextReader must only be used with connections returned by the Upgrader.
+func (c *Conn) NextReader(ctx context.Context) (Code, io.Reader, error) {
+	// discard the unread frames of the previous message
+	if c.reader != nil {
+		io.Copy(io.Discard, c.reader)
+		c.reader = nil
+	}
+
+	fr, err := c.nextFrame(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if fr.IsContinuation() {
+		ReleaseFrame(fr)
+		return 0, nil, c.protocolError(errUnexpectedContinuation)
+	}
+
+	c.reader = &messageReader{
+		fr: fr,
+		next: func() (*Frame, error) {
+			fr, err := c.nextFrame(ctx)
+			if err == nil && !fr.IsContinuation() {
+				ReleaseFrame(fr)
+				return nil, c.protocolError(errExpectedContinuation)
+			}
+
+			return fr, err
+		},
+	}
+
+	return fr.Code(), c.reader, nil
+}
+
+// nextFrame returns the next data frame handling the control frames.
+func (c *Conn) nextFrame(ctx context.Context) (*Frame, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+
+	for {
+		var fr *Frame
+
+		select {
+		case fr = <-c.input:
+		case err := <-c.errch:
+			c.readErr = unwrapCloseError(err)
+			return nil, c.readErr
+		case <-c.closer:
+			c.readErr = net.ErrClosed
+			return nil, c.readErr
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		if !fr.IsControl() {
+			return fr, nil
+		}
+
+		switch {
+		case fr.IsPing():
+			pong := AcquireFrame()
+			pong.SetCode(CodePong)
+			pong.SetPayload(fr.Payload())
+			pong.SetFin()
+
+			c.WriteFrame(pong)
+		case fr.IsClose():
+			cause := Error{Status: fr.Status()}
+
+			// the reason follows the status, if any
+			c.readErr = io.EOF
+			if cause.Status != StatusNone {
+				cause.Reason = string(fr.Payload())
+				c.readErr = cause
+			}
+
+			c.setCause(cause)
+			c.CloseDetail(cause.Status, "")
+		}
+
+		ReleaseFrame(fr)
+
+		if c.readErr != nil {
+			return nil, c.readErr
+		}
+	}
+}
+
+var (
+	errUnexpectedContinuation = errors.New("unexpected continuation frame")
+	errExpectedContinuation   = errors.New("expected continuation frame")
+)
+
+// protocolError closes the connection due to an unexpected frame.
+func (c *Conn) protocolError(err error) error {
+	c.CloseDetail(StatusProtocolError, err.Error())
+	c.readErr = err
+
+	return c.readErr
+}
+
+// NextWriter returns a writer sending a message of type code.
+//
+// The written data is sent in frames of FragmentSize bytes,
+// the last frame is sent when closing the writer.
+// Control frames can be sent while the message is being written,
+// but no other data frame can be sent until the writer is closed.
+func (c *Conn) NextWriter(code Code) io.WriteCloser {
+	fr := AcquireFrame()
+	fr.SetCode(code)
+
+	return &messageWriter{
+		fr:   fr,
+		size: c.FragmentSize,
+		flush: func(fr *Frame) (*Frame, error) {
+			if atomic.LoadInt32(&c.closed) == 1 {
+				ReleaseFrame(fr)
+				return nil, net.ErrClosed
+			}
+
+			c.WriteFrame(fr)
+
+			return AcquireFrame(), nil
+		},
+	}
+}
+
 func (c *Conn) Ping(data []byte) {
 	fr := AcquireFrame()
 	fr.SetPing()
@@ -207,21 +1066,57 @@ func (c *Conn) Ping(data []byte) {
 }
 
 func (c *Conn) Write(data []byte) (int, error) {
-	n := len(data)
+	c.WriteFrame(textFrame(data))
 
+	return len(data), nil
+}
+
+// textFrame returns a frame holding data as a text message.
+func textFrame(data []byte) *Frame {
 	fr := AcquireFrame()
 
 	fr.SetFin()
 	fr.SetPayload(data)
 	fr.SetText()
 
-	c.WriteFrame(fr)
-
-	return n, nil
+	return fr
 }
 
+// WriteFrame queues fr to be written. The frame is released once written.
+//
+// The frames written after the connection has been closed are discarded.
 func (c *Conn) WriteFrame(fr *Frame) {
-	c.output <- fr
+	if c.poll != nil {
+		c.pollWrite(fr)
+		return
+	}
+
+	// the frame must not be queued once the channels have been released
+	c.refMu.RLock()
+	defer c.refMu.RUnlock()
+
+	c.writeFrameLocked(fr)
+}
+
+// writeFrameLocked is WriteFrame for the callers holding refMu.
+//
+// refMu must not be locked twice: a pending release would deadlock.
+func (c *Conn) writeFrameLocked(fr *Frame) {
+	if c.poll != nil {
+		c.pollWrite(fr)
+		return
+	}
+
+	if c.connChans == nil {
+		ReleaseFrame(fr)
+		return
+	}
+
+	select {
+	case c.output <- fr:
+	case <-c.closer:
+		ReleaseFrame(fr)
+	}
 }
 
 func (c *Conn) Close() error {
@@ -231,7 +1126,17 @@ func (c *Conn) Close() error {
 }
 
 func (c *Conn) CloseDetail(status StatusCode, reason string) {
+	c.closeDetail(status, reason, false)
+}
+
+// closeDetail is CloseDetail, locked reports whether the caller holds refMu.
+func (c *Conn) closeDetail(status StatusCode, reason string, locked bool) {
 	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.setCause(Error{
+			Status: status,
+			Reason: reason,
+		})
+
 		fr := AcquireFrame()
 		fr.SetClose()
 		fr.SetStatus(status)
@@ -239,8 +1144,16 @@ func (c *Conn) CloseDetail(status StatusCode, reason string) {
 
 		io.WriteString(fr, reason)
 
-		c.WriteFrame(fr)
+		if locked {
+			c.writeFrameLocked(fr)
+		} else {
+			c.WriteFrame(fr)
+		}
 
 		close(c.closer)
+
+		if c.poll != nil {
+			c.poll.np.s.pollShutdown(c)
+		}
 	}
 }
@@ -2,9 +2,19 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttputil"
@@ -46,9 +56,12 @@ func configureServer(t *testing.T) (*fasthttp.Server, *fasthttputil.InmemoryList
 		stage++
 	})
 
-	ws.HandleClose(func(c *Conn, err error) {
-		if err != nil {
-			t.Fatal(err)
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		if info.Err != nil {
+			t.Fatal(info.Err)
+		}
+		if info.Status != StatusNone || info.Reason != "Bye" {
+			t.Fatalf("unexpected close: %s %s", info.Status, info.Reason)
 		}
 	})
 
@@ -153,10 +166,14 @@ func TestReadFrame(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// the server replies back before closing the connection
 	fr.Reset()
 	_, err = conn.ReadFrame(fr)
-	if !fr.IsContinuation() {
-		t.Fatalf("Unexpected frame %s", fr.Code())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsClose() || fr.Status() != StatusNone {
+		t.Fatalf("Unexpected frame %s: %s", fr.Code(), fr.Status())
 	}
 
 	ln.Close()
@@ -217,3 +234,741 @@ func TestReadFrame(t *testing.T) {
 // 		t.Fatal("timeout")
 // 	}
 // }
+
+func checkHandshakeDetails(t *testing.T, c *Conn) {
+	t.Helper()
+
+	if uri := c.RequestURI(); !bytes.HasSuffix(uri, []byte("/chat?room=1")) {
+		t.Errorf("unexpected request uri: %s", uri)
+	}
+	if v := c.Header("X-Custom"); string(v) != "custom" {
+		t.Errorf("unexpected header value: %s", v)
+	}
+	if v := c.Cookie("session"); string(v) != "abc" {
+		t.Errorf("unexpected cookie value: %s", v)
+	}
+	if c.TLSConnectionState() != nil {
+		t.Error("unexpected TLS state")
+	}
+	if p := c.Subprotocol(); p != "chat" {
+		t.Errorf("unexpected subprotocol: %s", p)
+	}
+}
+
+func handshakeRequest() *fasthttp.Request {
+	req := fasthttp.AcquireRequest()
+	req.Header.Set("X-Custom", "custom")
+	req.Header.SetCookie("session", "abc")
+	req.Header.SetBytesK(wsHeaderProtocol, "chat")
+
+	return req
+}
+
+func TestHandshakeDetails(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	done := make(chan struct{})
+
+	ws := Server{
+		Protocols: []string{"chat"},
+	}
+	ws.HandleOpen(func(c *Conn) {
+		checkHandshakeDetails(t, c)
+		close(done)
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+	defer ln.Close()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := handshakeRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	conn, err := ClientWithHeaders(c, "http://localhost/chat?room=1", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNetHandshakeDetails(t *testing.T) {
+	done := make(chan struct{})
+
+	ws := Server{
+		Protocols: []string{"chat"},
+	}
+	ws.HandleOpen(func(c *Conn) {
+		checkHandshakeDetails(t, c)
+		close(done)
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	req := handshakeRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	conn, err := DialWithHeaders("ws"+strings.TrimPrefix(s.URL, "http")+"/chat?room=1", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConnNextWriter(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		c.FragmentSize = 4
+
+		w := c.NextWriter(CodeBinary)
+		io.WriteString(w, "Hello ")
+		c.Ping([]byte("ping"))
+		io.WriteString(w, "world")
+		w.Close()
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := []struct {
+		code    Code
+		fin     bool
+		payload string
+	}{
+		{CodeBinary, false, "Hell"},
+		{CodePing, true, "ping"},
+		{CodeContinuation, false, "o wo"},
+		{CodeContinuation, true, "rld"},
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for _, e := range expected {
+		fr.Reset()
+		if _, err := conn.ReadFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Code() != e.code || fr.IsFin() != e.fin || string(fr.Payload()) != e.payload {
+			t.Fatalf("unexpected frame %s fin=%v: %q", fr.Code(), fr.IsFin(), fr.Payload())
+		}
+	}
+}
+
+func checkContextCause(t *testing.T, ctx context.Context, expected error) {
+	t.Helper()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if cause := context.Cause(ctx); !errors.Is(cause, expected) {
+		t.Fatalf("unexpected cause: %v", cause)
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ctxs := make(chan context.Context, 1)
+	allocs := make(chan float64, 1)
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		ctxs <- c.Context()
+
+		// the context is built once per connection
+		allocs <- testing.AllocsPerRun(10, func() {
+			_ = c.Context()
+		})
+	})
+
+	s := fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue("request", "value")
+			ws.Upgrade(ctx)
+		},
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := <-ctxs
+	if v := ctx.Value("request"); v != "value" {
+		t.Fatalf("unexpected user value: %v", v)
+	}
+
+	conn.CloseDetail(StatusCode(4000), "bye")
+
+	checkContextCause(t, ctx, Error{Status: 4000, Reason: "bye"})
+}
+
+func TestNetConnContext(t *testing.T) {
+	ctxs := make(chan context.Context, 1)
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		ctxs <- c.Context()
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Close()
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := <-ctxs
+
+	// the request context is cancelled once the handler returns, not the Conn context
+	time.Sleep(time.Millisecond * 50)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("unexpected context error: %v", err)
+	}
+
+	conn.Write([]byte("close"))
+
+	checkContextCause(t, ctx, Error{Status: StatusNone})
+}
+
+func TestConnUserValueConcurrent(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				key := fmt.Sprintf("key%d", i)
+				c.SetUserValue(key, i)
+				if v := c.Context().Value(key); v != i {
+					t.Errorf("unexpected user value: %v", v)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConnReader(t *testing.T) {
+	cr := connReader{
+		r:       strings.NewReader("d"),
+		pending: []byte("bc"),
+	}
+
+	if !cr.buffered() {
+		t.Fatal("expected pending data")
+	}
+
+	b, err := io.ReadAll(&cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bcd" {
+		t.Fatalf("unexpected data: %s", b)
+	}
+
+	cr = connReader{
+		r: io.MultiReader(strings.NewReader("a"), errReader{io.ErrUnexpectedEOF}),
+	}
+
+	// the peeked byte is read before the error
+	cr.wait()
+	if !cr.buffered() {
+		t.Fatal("expected peeked data")
+	}
+
+	b, err = io.ReadAll(&cr)
+	if string(b) != "a" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected read: %q %v", b, err)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestConnBufferSize(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	ws := Server{
+		ReadBufferSize:  16,
+		WriteBufferSize: 16,
+	}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the messages are larger than the read buffer and, except "b",
+	// than the payloads copied into the write buffer
+	for _, msg := range []string{strings.Repeat("a", 100), "b", strings.Repeat("c", 5000)} {
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		_, b, err := conn.ReadMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != msg {
+			t.Fatalf("unexpected message of %d bytes", len(b))
+		}
+	}
+}
+
+// countingConn counts the writes discarding the written data.
+type countingConn struct {
+	net.Conn
+
+	writes int64
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCountingConn(c net.Conn) *countingConn {
+	return &countingConn{
+		Conn:   c,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	if c.Conn != nil {
+		return c.Conn.Read(b)
+	}
+
+	<-c.closed
+
+	return 0, io.EOF
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+
+	if c.Conn != nil {
+		return c.Conn.Write(b)
+	}
+
+	return len(b), nil
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+
+	if c.Conn != nil {
+		return c.Conn.Close()
+	}
+
+	return nil
+}
+
+func TestConnWriteBatch(t *testing.T) {
+	cc := newCountingConn(nil)
+
+	c := acquireConn(cc, cc)
+	c.writeBatchSize = 4
+
+	// the frames queued together are written in batches
+	for i := 0; i < 10; i++ {
+		io.WriteString(c, "hello")
+	}
+
+	c.start()
+	defer c.Close()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&cc.writes) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected writes: %d", atomic.LoadInt64(&cc.writes))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnWriteShortClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := acquireConn(c1, c1)
+	c.start()
+
+	// a close frame holding an incomplete status
+	fr := AcquireFrame()
+	fr.SetClose()
+	fr.SetFin()
+	fr.b = append(fr.b[:0], 'x')
+	c.WriteFrame(fr)
+
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	rfr := AcquireFrame()
+	defer ReleaseFrame(rfr)
+
+	if _, err := rfr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+	if !rfr.IsClose() || rfr.PayloadLen() != 1 {
+		t.Fatalf("unexpected frame %s: %q", rfr.Code(), rfr.b)
+	}
+
+	c.wg.Wait()
+
+	if info := c.CloseInfo(); info.Remote || info.Status != StatusNone || info.Reason != "" {
+		t.Fatalf("unexpected close: %+v", info)
+	}
+}
+
+func TestConnWriteLargeFrames(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	messages := []string{
+		"a", strings.Repeat("b", 100), "c", "d", strings.Repeat("e", 70000), "f",
+	}
+
+	ws := Server{
+		WriteBufferSize: 16,
+	}
+	ws.HandleOpen(func(c *Conn) {
+		for _, msg := range messages {
+			io.WriteString(c, msg)
+		}
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range messages {
+		_, b, err := conn.ReadMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != msg {
+			t.Fatalf("unexpected message of %d bytes, expected %d", len(b), len(msg))
+		}
+	}
+}
+
+func TestConnRefPendingRelease(t *testing.T) {
+	cc := newCountingConn(nil)
+
+	c := acquireConn(cc, cc)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		c.Ref().Do(func(c *Conn) {
+			released := make(chan struct{})
+			go func() {
+				releaseConn(c)
+				close(released)
+			}()
+
+			// the release is waiting for the reference
+			time.Sleep(time.Millisecond * 50)
+
+			c.writeFrameLocked(textFrame([]byte("queued")))
+			c.closeDetail(StatusNone, "", true)
+
+			select {
+			case <-released:
+				t.Error("released while referenced")
+			default:
+			}
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestReleaseConn(t *testing.T) {
+	cc := newCountingConn(nil)
+
+	c := acquireConn(cc, cc)
+	c.SetUserValue("key", "value")
+
+	ref, ctx := c.Ref(), c.Context()
+	ch := c.connChans
+
+	// frames left behind once closed
+	c.Close()
+	io.WriteString(c, "dropped")
+
+	releaseConn(c)
+
+	if _, err := ref.Write([]byte("stale")); err != ErrStaleConn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ref.Close(); err != ErrStaleConn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := ctx.Value("key"); v != nil {
+		t.Fatalf("unexpected stale context value: %v", v)
+	}
+	if err := (ConnRef{}).Close(); err != ErrStaleConn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the channels are drained and detached from the Conn
+	if c.connChans != nil || len(ch.input) != 0 || len(ch.output) != 0 {
+		t.Fatal("channels not released")
+	}
+
+	// the frames written using the released Conn are discarded
+	io.WriteString(c, "stale")
+	c.Close()
+
+	if len(ch.output) != 0 {
+		t.Fatal("stale frame queued")
+	}
+}
+
+func TestServerReuseConns(t *testing.T) {
+	type openConn struct {
+		c   *Conn
+		ref ConnRef
+		ctx context.Context
+	}
+
+	var (
+		opened = make(chan openConn, 1)
+		closed = make(chan CloseInfo, 1)
+	)
+
+	ws := Server{
+		ReuseConns: true,
+	}
+	ws.HandleOpen(func(c *Conn) {
+		c.SetUserValue("id", c.ID())
+		opened <- openConn{c, c.Ref(), c.Context()}
+	})
+	// a goroutine writing using the Conn past its CloseHandler
+	var (
+		lateOnce  sync.Once
+		lateWrite = make(chan struct{})
+		lateDone  = make(chan struct{})
+	)
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		lateOnce.Do(func() {
+			go func() {
+				<-lateWrite
+				c.Write([]byte("stale"))
+				c.CloseDetail(StatusGoAway, "")
+				close(lateDone)
+			}()
+		})
+
+		closed <- info
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	dial := func() *Client {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := MakeClient(c, "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+		return conn
+	}
+
+	readMessage := func(conn *Client, expected string) {
+		t.Helper()
+
+		_, b, err := conn.ReadMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s <> %s", b, expected)
+		}
+	}
+
+	conn := dial()
+	first := <-opened
+
+	if _, err := first.ref.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(conn, "first")
+
+	conn.Close()
+	<-closed
+
+	// the Conn is released once the CloseHandler returns
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, err := first.ref.Write([]byte("stale")); err == ErrStaleConn {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Conn not released")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	conn = dial()
+	defer conn.Close()
+
+	second := <-opened
+
+	// the stale reference must not reach the second connection
+	if _, err := first.ref.Write([]byte("stale")); err != ErrStaleConn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := first.ctx.Value("id"); v != nil {
+		t.Fatalf("unexpected stale context value: %v", v)
+	}
+	if v := second.ctx.Value("id"); v != second.c.ID() {
+		t.Fatalf("unexpected context value: %v", v)
+	}
+
+	// nor the goroutine still using the first Conn
+	close(lateWrite)
+	<-lateDone
+
+	if _, err := second.ref.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(conn, "second")
+
+	if err := second.c.Context().Err(); err != nil {
+		t.Fatalf("second connection closed: %v", context.Cause(second.c.Context()))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // StatusCode is sent when closing a connection.
@@ -124,6 +125,9 @@ type Frame struct {
 	mask          []byte
 	b             []byte
 	statusDefined bool
+
+	// borrowed reports whether b references the buffer parsed by ParseFrame.
+	borrowed bool
 }
 
 // CopyTo copies the frame `fr` to `fr2`
@@ -158,6 +162,8 @@ Data: %v`,
 
 var framePool = sync.Pool{
 	New: func() interface{} {
+		atomic.AddUint64(&poolStats.allocated, 1)
+
 		fr := &Frame{
 			max:  DefaultPayloadSize,
 			op:   make([]byte, opSize),
@@ -175,12 +181,128 @@ func AcquireFrame() *Frame {
 }
 
 // ReleaseFrame puts fr Frame into the global pool.
+//
+// The payload buffers larger than the max retained size are not kept,
+// see SetMaxRetainedPayloadSize.
 func ReleaseFrame(fr *Frame) {
-	fr.Reset()
+	fr.release()
 	framePool.Put(fr)
 }
 
+// release restores the defaults of fr before pooling it.
+func (fr *Frame) release() {
+	fr.Reset()
+	fr.max = DefaultPayloadSize
+	fr.releasePayload()
+}
+
+// smallPayloadSize is the max capacity of the payload buffers kept by
+// the pooled frames, the larger buffers are pooled apart.
+const smallPayloadSize = 4096
+
+// DefaultMaxRetainedPayloadSize defines the default max capacity of
+// the payload buffers kept once the frames are released (when none was defined).
+const DefaultMaxRetainedPayloadSize = DefaultPayloadSize
+
+var (
+	maxRetainedPayloadSize int64 = DefaultMaxRetainedPayloadSize
+
+	// largePayloadPool pools the payload buffers larger than smallPayloadSize.
+	largePayloadPool sync.Pool
+
+	poolStats struct {
+		allocated     uint64
+		largeReused   uint64
+		largeReleased uint64
+		dropped       uint64
+	}
+)
+
+// SetMaxRetainedPayloadSize sets the max capacity of the payload buffers
+// kept by the pool once the frames are released, the larger buffers
+// are left to the garbage collector.
+//
+// If size is not positive DefaultMaxRetainedPayloadSize is used.
+func SetMaxRetainedPayloadSize(size int) {
+	if size <= 0 {
+		size = DefaultMaxRetainedPayloadSize
+	}
+
+	atomic.StoreInt64(&maxRetainedPayloadSize, int64(size))
+}
+
+// PoolStats are the statistics of the frame pool.
+type PoolStats struct {
+	// Allocated is the number of frames allocated by the pool.
+	Allocated uint64
+	// LargeReused is the number of large payload buffers reused.
+	LargeReused uint64
+	// LargeReleased is the number of large payload buffers returned to the pool.
+	LargeReleased uint64
+	// Dropped is the number of payload buffers not kept for exceeding
+	// the max retained size.
+	Dropped uint64
+}
+
+// FramePoolStats returns the statistics of the frame pool.
+func FramePoolStats() PoolStats {
+	return PoolStats{
+		Allocated:     atomic.LoadUint64(&poolStats.allocated),
+		LargeReused:   atomic.LoadUint64(&poolStats.largeReused),
+		LargeReleased: atomic.LoadUint64(&poolStats.largeReleased),
+		Dropped:       atomic.LoadUint64(&poolStats.dropped),
+	}
+}
+
+// releasePayload pools apart the large payload buffer of fr.
+func (fr *Frame) releasePayload() {
+	size := cap(fr.b)
+	if size <= smallPayloadSize {
+		return
+	}
+
+	b := fr.b[:0]
+	fr.b = nil
+
+	if int64(size) > atomic.LoadInt64(&maxRetainedPayloadSize) {
+		atomic.AddUint64(&poolStats.dropped, 1)
+		return
+	}
+
+	atomic.AddUint64(&poolStats.largeReleased, 1)
+	largePayloadPool.Put(&b)
+}
+
+// growPayload makes room for a payload of n bytes
+// reusing the large buffers of the pool.
+func (fr *Frame) growPayload(n int) {
+	if n <= cap(fr.b) {
+		return
+	}
+
+	if n > smallPayloadSize {
+		if b, ok := largePayloadPool.Get().(*[]byte); ok {
+			if cap(*b) >= n {
+				atomic.AddUint64(&poolStats.largeReused, 1)
+				fr.b = append((*b)[:0], fr.b...)
+
+				return
+			}
+
+			largePayloadPool.Put(b)
+		}
+	}
+
+	fr.b = append(fr.b, make([]byte, n-len(fr.b))...)[:len(fr.b)]
+}
+
 func (fr *Frame) resetPayload() {
+	// the parsed buffer is not owned by the frame
+	if fr.borrowed {
+		fr.b, fr.borrowed = nil, false
+		return
+	}
+
 	fr.b = fr.b[:0]
 }
 
@@ -280,8 +402,15 @@ func (fr *Frame) MaskKey() []byte {
 }
 
 // Payload returns the frame payload.
+//
+// The payload of a close frame is the reason following the status,
+// empty if the status is missing or incomplete.
 func (fr *Frame) Payload() []byte {
 	if fr.IsClose() && len(fr.b) != 0 {
+		if len(fr.b) < 2 {
+			return fr.b[:0]
+		}
+
 		return fr.b[2:]
 	}
 
@@ -375,6 +504,7 @@ func (fr *Frame) UnsetMask() {
 // Write appends the parsed bytes to the frame's payload
 func (fr *Frame) Write(b []byte) (int, error) {
 	n := len(b)
+	fr.growPayload(len(fr.b) + n)
 	fr.b = append(fr.b, b...)
 	return n, nil
 }
@@ -390,6 +520,7 @@ func (fr *Frame) SetPayload(b []byte) {
 		}
 	}
 
+	fr.growPayload(n + len(b))
 	fr.b = append(fr.b[:n], b...)
 }
 
@@ -439,6 +570,41 @@ func (fr *Frame) Unmask() {
 	fr.UnsetMask()
 }
 
+// appendHeader appends the header of the frame to b.
+func (fr *Frame) appendHeader(b []byte) []byte {
+	s := fr.setPayloadLen()
+
+	b = append(b, fr.op[:s+2]...)
+	if fr.IsMasked() {
+		b = append(b, fr.mask...)
+	}
+
+	return b
+}
+
+// wireSize returns the size of the encoded frame.
+func (fr *Frame) wireSize() int {
+	n := 2 + len(fr.b)
+
+	switch {
+	case len(fr.b) > 65535:
+		n += 8
+	case len(fr.b) > 125:
+		n += 2
+	}
+
+	if fr.IsMasked() {
+		n += 4
+	}
+
+	return n
+}
+
+// AppendTo appends the encoded frame to dst returning the extended buffer.
+func (fr *Frame) AppendTo(dst []byte) []byte {
+	return append(fr.appendHeader(dst), fr.b...)
+}
+
 // WriteTo writes the frame into wr.
 func (fr *Frame) WriteTo(wr io.Writer) (n int64, err error) {
 	var ni int
@@ -468,6 +634,88 @@ func (fr *Frame) WriteTo(wr io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// Role is the role of a WebSocket endpoint.
+type Role uint8
+
+const (
+	// RoleServer is the role of the endpoint accepting the connection.
+	RoleServer Role = iota
+	// RoleClient is the role of the endpoint initiating the connection.
+	RoleClient
+)
+
+func (role Role) String() string {
+	if role == RoleClient {
+		return "client"
+	}
+
+	return "server"
+}
+
+var (
+	// ErrReservedBits is returned when a frame sets the reserved bits
+	// which are only used by the extensions.
+	ErrReservedBits = errors.New("reserved bits set")
+	// ErrInvalidCode is returned when a frame uses a reserved opcode.
+	ErrInvalidCode = errors.New("invalid frame opcode")
+	// ErrControlTooBig is returned when a control frame payload exceeds 125 bytes.
+	ErrControlTooBig = errors.New("control frame payload is bigger than 125 bytes")
+	// ErrFragmentedControl is returned when a control frame is fragmented.
+	ErrFragmentedControl = errors.New("fragmented control frame")
+	// ErrUnmaskedFrame is returned when a frame sent by a client is not masked.
+	ErrUnmaskedFrame = errors.New("client frame is not masked")
+	// ErrMaskedFrame is returned when a frame sent by a server is masked.
+	ErrMaskedFrame = errors.New("server frame is masked")
+	// ErrInvalidClosePayload is returned when a close frame payload has 1 byte,
+	// that is, the status code is incomplete.
+	ErrInvalidClosePayload = errors.New("close frame payload of 1 byte")
+)
+
+// Validate checks whether fr follows the protocol rules (RFC 6455 section 5)
+// for a frame sent by an endpoint of the given role.
+//
+// The frames sent by the clients must be masked while the ones sent by
+// the servers must not. The returned errors can be checked using errors.Is.
+func (fr *Frame) Validate(role Role) error {
+	if err := fr.validate(); err != nil {
+		return err
+	}
+
+	if role == RoleClient && !fr.IsMasked() {
+		return ErrUnmaskedFrame
+	}
+	if role == RoleServer && fr.IsMasked() {
+		return ErrMaskedFrame
+	}
+
+	return nil
+}
+
+// validate checks the rules of Validate regardless of the masking.
+func (fr *Frame) validate() error {
+	if fr.HasRSV1() || fr.HasRSV2() || fr.HasRSV3() {
+		return ErrReservedBits
+	}
+
+	switch fr.Code() {
+	case CodeContinuation, CodeText, CodeBinary:
+	case CodeClose, CodePing, CodePong:
+		if len(fr.b) > 125 {
+			return ErrControlTooBig
+		}
+		if !fr.IsFin() {
+			return ErrFragmentedControl
+		}
+		if fr.IsClose() && len(fr.b) == 1 {
+			return ErrInvalidClosePayload
+		}
+	default:
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
 // Status returns StatusCode.
 func (fr *Frame) Status() (status StatusCode) {
 	if len(fr.b) < 2 {
@@ -486,11 +734,11 @@ func (fr *Frame) Status() (status StatusCode) {
 // Status code is usually used in Close request.
 func (fr *Frame) SetStatus(status StatusCode) {
 	if !fr.statusDefined {
-		if cap(fr.b) < 2 {
-			fr.b = append(fr.b, make([]byte, 2)...)
-		}
-
-		fr.b = append(fr.b[:2], fr.b...)
+		// the payload is moved after the status
+		n := len(fr.b)
+		fr.growPayload(n + 2)
+		fr.b = fr.b[:n+2]
+		copy(fr.b[2:], fr.b[:n])
 	}
 	fr.statusDefined = true
 
@@ -512,27 +760,124 @@ func (fr *Frame) mustRead() (n int) {
 	return
 }
 
-var (
-	// EOF represents an io.EOF error.
-	errMalformedHeader = errors.New("malformed header")
-	errBadHeaderSize   = errors.New("header size is insufficient")
-)
-
 // ReadFrom fills fr reading from rd.
 func (fr *Frame) ReadFrom(rd io.Reader) (int64, error) {
 	return fr.readFrom(rd)
 }
 
 var (
-	errReadingHeader = errors.New("error reading frame header")
-	errReadingLen    = errors.New("error reading b length")
-	errReadingMask   = errors.New("error reading mask")
-	errLenTooBig     = errors.New("message length is bigger than expected")
-	errStatusLen     = errors.New("length of the status must be = 2")
+	// ErrTruncatedFrame is returned when the data ends in the middle of a frame.
+	//
+	// ErrTruncatedFrame wraps io.ErrUnexpectedEOF.
+	ErrTruncatedFrame = fmt.Errorf("truncated frame: %w", io.ErrUnexpectedEOF)
+	// ErrFrameTooBig is returned when the payload length exceeds the max payload size.
+	ErrFrameTooBig = errors.New("frame payload is bigger than expected")
+	// ErrInvalidLength is returned when the payload length has the most
+	// significant bit set or is not encoded using the minimal number of bytes.
+	ErrInvalidLength = errors.New("invalid frame payload length")
 )
 
 const limitLen = 1 << 32
 
+// checkLen checks the encoding of the payload length.
+func (fr *Frame) checkLen() error {
+	switch fr.op[1] & 127 {
+	case 126:
+		if fr.Len() < 126 {
+			return ErrInvalidLength
+		}
+	case 127:
+		if fr.op[2]&0x80 != 0 || fr.Len() <= 65535 {
+			return ErrInvalidLength
+		}
+	}
+
+	if fr.Len() > limitLen {
+		return ErrFrameTooBig
+	}
+
+	return nil
+}
+
+// truncated reports the errors ending the data in the middle of a frame as ErrTruncatedFrame.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncatedFrame
+	}
+
+	return err
+}
+
+// ParseFrame parses the frame found at the beginning of b
+// returning the number of bytes the frame spans.
+//
+// The payload is not copied but references b, thus modifying the payload
+// (i.e. unmasking it) modifies b, and b must not be reused until the frame is released.
+// io.ErrShortBuffer is returned if b doesn't hold a whole frame.
+//
+// The frame must be released using ReleaseFrame.
+func ParseFrame(b []byte) (fr *Frame, n int, err error) {
+	fr = AcquireFrame()
+
+	n, err = fr.parse(b)
+	if err != nil {
+		ReleaseFrame(fr)
+		return nil, 0, err
+	}
+
+	return fr, n, nil
+}
+
+func (fr *Frame) parse(b []byte) (int, error) {
+	n, err := fr.parseHeader(b)
+	if err != nil {
+		return 0, err
+	}
+
+	frameSize := fr.Len()
+	if uint64(len(b)-n) < frameSize {
+		return 0, io.ErrShortBuffer
+	}
+
+	// the payload cannot be extended over the following bytes of b
+	end := n + int(frameSize)
+	fr.b = b[n:end:end]
+	fr.borrowed = true
+
+	return end, nil
+}
+
+// parseHeader parses the header of the frame found at the beginning of b
+// returning its length, io.ErrShortBuffer if b doesn't hold the whole header.
+func (fr *Frame) parseHeader(b []byte) (int, error) {
+	// first 2 bytes (stuff + opcode + maskbit + payload len)
+	if len(b) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	copy(fr.op[:2], b)
+
+	n := fr.mustRead() + 2
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+	copy(fr.op[2:n], b[2:n])
+
+	if fr.IsMasked() {
+		if len(b) < n+4 {
+			return 0, io.ErrShortBuffer
+		}
+
+		copy(fr.mask[:4], b[n:n+4])
+		n += 4
+	}
+
+	if err := fr.checkLen(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 func (fr *Frame) readFrom(r io.Reader) (int64, error) {
 	var err error
 	var n, m int
@@ -540,8 +885,9 @@ func (fr *Frame) readFrom(r io.Reader) (int64, error) {
 	// read the first 2 bytes (stuff + opcode + maskbit + payload len)
 	n, err = io.ReadFull(r, fr.op[:2])
 	if err != nil {
+		// io.EOF if no frame was being read
 		if errors.Is(err, io.ErrUnexpectedEOF) {
-			err = errReadingHeader
+			err = ErrTruncatedFrame
 		}
 
 		return int64(n), err
@@ -553,45 +899,36 @@ func (fr *Frame) readFrom(r io.Reader) (int64, error) {
 	if m > 2 { // reading length
 		n, err = io.ReadFull(r, fr.op[2:m]) // start from 2 to fill in 2:m
 		if err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				err = errReadingHeader
-			}
-
-			return int64(n), err
+			return int64(n), truncated(err)
 		}
 	}
 
 	if fr.IsMasked() { // reading mask
 		n, err = io.ReadFull(r, fr.mask[:4])
 		if err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				err = errReadingHeader
-			}
-
-			return int64(n), err
+			return int64(n), truncated(err)
 		}
 	}
 
 	// reading the payload
+	if err = fr.checkLen(); err != nil {
+		return int64(n), err
+	}
+
 	frameSize := fr.Len()
-	if (fr.max > 0 && frameSize > fr.max) || frameSize > limitLen {
-		return int64(n), errLenTooBig
+	if fr.max > 0 && frameSize > fr.max {
+		return int64(n), ErrFrameTooBig
 	}
 	if frameSize == 0 { // read the payload
 		return int64(n), err
 	}
 	nn := int64(frameSize)
-	if nn < 0 {
-		panic("uint64 to int64 conversion gave a negative number")
-	}
 
 	if nn > 0 {
-		if rLen := nn - int64(cap(fr.b)); rLen > 0 {
-			fr.b = append(fr.b[:cap(fr.b)], make([]byte, rLen)...)
-		}
-
+		fr.growPayload(int(nn))
 		fr.b = fr.b[:nn]
 		n, err = io.ReadFull(r, fr.b)
+		err = truncated(err)
 	}
 
 	return int64(n), err
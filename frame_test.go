@@ -3,6 +3,7 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 )
@@ -123,3 +124,279 @@ func BenchmarkRead(b *testing.B) {
 		ReleaseFrame(fr)
 	})
 }
+
+func TestParseFrame(t *testing.T) {
+	b := append(append([]byte(nil), littlePacket...), hugePacket...)
+
+	fr, n, err := ParseFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(littlePacket) {
+		t.Fatalf("unexpected length: %d<>%d", n, len(littlePacket))
+	}
+	checkValues(fr, t, false, true, littlePacket[2:])
+	ReleaseFrame(fr)
+
+	fr, n, err = ParseFrame(b[n:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(hugePacket) {
+		t.Fatalf("unexpected length: %d<>%d", n, len(hugePacket))
+	}
+	checkValues(fr, t, false, true, hugePacket[4:])
+
+	// the payload references b
+	b[len(littlePacket)+4] = 'x'
+	if fr.Payload()[0] != 'x' {
+		t.Fatal("payload was copied")
+	}
+
+	// b is not modified once the frame is reused
+	fr.Reset()
+	fr.SetPayload([]byte("reused"))
+	if b[len(littlePacket)+4] != 'x' {
+		t.Fatal("buffer modified by a released frame")
+	}
+	ReleaseFrame(fr)
+}
+
+func TestParseFrameShort(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetFin()
+	fr.SetPayload(bytes.Repeat([]byte("a"), 300))
+	fr.Mask()
+
+	b := fr.AppendTo(nil)
+
+	for i := 0; i < len(b); i++ {
+		if _, _, err := ParseFrame(b[:i]); err != io.ErrShortBuffer {
+			t.Fatalf("unexpected error parsing %d bytes: %v", i, err)
+		}
+	}
+
+	fr2, n, err := ParseFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseFrame(fr2)
+
+	if n != len(b) || !fr2.IsMasked() || !bytes.Equal(fr2.MaskKey(), fr.MaskKey()) {
+		t.Fatalf("unexpected frame: %s", fr2)
+	}
+
+	fr2.Unmask()
+	checkValues(fr2, t, false, true, bytes.Repeat([]byte("a"), 300))
+}
+
+func TestFrameSetStatusReleasedPayload(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	// the large payload buffers are not kept by the released frames
+	fr.SetPayload(make([]byte, smallPayloadSize+1))
+	fr.release()
+
+	fr.SetClose()
+	fr.SetStatus(StatusGoAway)
+	io.WriteString(fr, "bye")
+
+	if fr.Status() != StatusGoAway || string(fr.Payload()) != "bye" {
+		t.Fatalf("unexpected close frame: %d %q", fr.Status(), fr.Payload())
+	}
+}
+
+func TestFramePayloadShortClose(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetClose()
+	fr.b = append(fr.b[:0], 'x')
+
+	if fr.Status() != StatusNone || len(fr.Payload()) != 0 {
+		t.Fatalf("unexpected close frame: %d %q", fr.Status(), fr.Payload())
+	}
+}
+
+func TestFrameAppendTo(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusGoAway)
+	fr.SetPayload([]byte("bye"))
+
+	var bf bytes.Buffer
+	fr.WriteTo(&bf)
+
+	prefix := []byte("prefix")
+
+	b := fr.AppendTo(prefix)
+	if !bytes.Equal(b[:len(prefix)], prefix) || !bytes.Equal(b[len(prefix):], bf.Bytes()) {
+		t.Fatalf("%v <> %v", b[len(prefix):], bf.Bytes())
+	}
+}
+
+func BenchmarkParseFrame(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		fr, _, err := ParseFrame(hugePacket)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		ReleaseFrame(fr)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		max  uint64
+		err  error
+	}{
+		{"empty", nil, 0, io.EOF},
+		{"truncated header", []byte{0x81}, 0, ErrTruncatedFrame},
+		{"truncated length", []byte{0x81, 126, 0}, 0, ErrTruncatedFrame},
+		{"truncated mask", []byte{0x81, 0x85, 1, 2}, 0, ErrTruncatedFrame},
+		{"truncated payload", []byte{0x81, 5, 'a', 'b'}, 0, ErrTruncatedFrame},
+		{"too big", []byte{0x81, 5, 'a', 'b', 'c', 'd', 'e'}, 4, ErrFrameTooBig},
+		{"too big 64-bit", []byte{0x81, 127, 0, 0, 0, 1, 0, 0, 0, 1}, 0, ErrFrameTooBig},
+		{"msb set", []byte{0x81, 127, 0x80, 0, 0, 0, 0, 0, 0, 1}, 0, ErrInvalidLength},
+		{"non-minimal 16-bit", []byte{0x81, 126, 0, 125}, 0, ErrInvalidLength},
+		{"non-minimal 64-bit", []byte{0x81, 127, 0, 0, 0, 0, 0, 0, 0xff, 0xff}, 0, ErrInvalidLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := AcquireFrame()
+			defer ReleaseFrame(fr)
+
+			fr.SetPayloadSize(DefaultPayloadSize)
+			if tt.max != 0 {
+				fr.SetPayloadSize(tt.max)
+			}
+
+			if _, err := fr.ReadFrom(bytes.NewReader(tt.b)); !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: %v<>%v", err, tt.err)
+			}
+
+			// the parsing errors are the same but for the truncated frames
+			_, _, err := ParseFrame(tt.b)
+			switch {
+			case tt.err == io.EOF || tt.err == ErrTruncatedFrame:
+				if err != io.ErrShortBuffer {
+					t.Fatalf("unexpected parse error: %v", err)
+				}
+			case tt.max == 0 && !errors.Is(err, tt.err):
+				t.Fatalf("unexpected parse error: %v<>%v", err, tt.err)
+			}
+		})
+	}
+
+	if !errors.Is(ErrTruncatedFrame, io.ErrUnexpectedEOF) {
+		t.Fatal("ErrTruncatedFrame must match io.ErrUnexpectedEOF")
+	}
+}
+
+func TestFrameValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(fr *Frame)
+		role  Role
+		err   error
+	}{
+		{"server text", func(fr *Frame) { fr.SetText() }, RoleServer, nil},
+		{"client text", func(fr *Frame) { fr.SetText(); fr.Mask() }, RoleClient, nil},
+		{"client close", func(fr *Frame) { fr.SetClose(); fr.SetStatus(StatusNone); fr.Mask() }, RoleClient, nil},
+		{"rsv1", func(fr *Frame) { fr.SetText(); fr.SetRSV1() }, RoleServer, ErrReservedBits},
+		{"rsv3", func(fr *Frame) { fr.SetText(); fr.SetRSV3() }, RoleServer, ErrReservedBits},
+		{"reserved opcode", func(fr *Frame) { fr.SetCode(Code(3)) }, RoleServer, ErrInvalidCode},
+		{"reserved control opcode", func(fr *Frame) { fr.SetCode(Code(0xB)) }, RoleServer, ErrInvalidCode},
+		{"big ping", func(fr *Frame) { fr.SetPing(); fr.SetPayload(make([]byte, 126)) }, RoleServer, ErrControlTooBig},
+		{"fragmented ping", func(fr *Frame) { fr.SetPing(); fr.op[0] &^= finBit }, RoleServer, ErrFragmentedControl},
+		{"short close", func(fr *Frame) { fr.SetClose(); fr.b = append(fr.b[:0], 'x') }, RoleServer, ErrInvalidClosePayload},
+		{"unmasked client", func(fr *Frame) { fr.SetBinary() }, RoleClient, ErrUnmaskedFrame},
+		{"masked server", func(fr *Frame) { fr.SetBinary(); fr.Mask() }, RoleServer, ErrMaskedFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := AcquireFrame()
+			defer ReleaseFrame(fr)
+
+			fr.SetFin()
+			tt.setup(fr)
+
+			if err := fr.Validate(tt.role); !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: %v<>%v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReleaseFramePayload(t *testing.T) {
+	SetMaxRetainedPayloadSize(1 << 16)
+	defer SetMaxRetainedPayloadSize(0)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	tests := []struct {
+		size     int
+		released uint64
+		dropped  uint64
+	}{
+		{smallPayloadSize, 0, 0},
+		{1 << 15, 1, 0},
+		{1 << 17, 0, 1},
+	}
+
+	for _, tt := range tests {
+		stats := FramePoolStats()
+
+		fr.SetPayloadSize(1)
+		fr.b = make([]byte, 0, tt.size)
+		fr.release()
+
+		if fr.PayloadSize() != DefaultPayloadSize {
+			t.Fatalf("unexpected payload size: %d", fr.PayloadSize())
+		}
+
+		// the frames only keep the small buffers
+		if cap(fr.b) > smallPayloadSize {
+			t.Fatalf("frame keeps a buffer of %d bytes", cap(fr.b))
+		}
+
+		after := FramePoolStats()
+		if after.LargeReleased-stats.LargeReleased != tt.released || after.Dropped-stats.Dropped != tt.dropped {
+			t.Fatalf("unexpected stats releasing %d bytes: %+v -> %+v", tt.size, stats, after)
+		}
+	}
+}
+
+func TestFrameGrowPayload(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	payload := bytes.Repeat([]byte("abc"), smallPayloadSize)
+
+	for i := 0; i < 3; i++ {
+		fr.release()
+
+		// the payload is kept while growing
+		fr.Write(payload[:10])
+		fr.Write(payload[10:])
+
+		if !bytes.Equal(fr.Payload(), payload) {
+			t.Fatal("unexpected payload")
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/xenking/websocket
 
-go 1.17
+go 1.21
 
 require (
 	github.com/valyala/fasthttp v1.40.0
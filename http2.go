@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// isExtendedConnect reports whether req is a WebSocket
+// bootstrapped over HTTP/2 as defined in RFC 8441.
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect &&
+		equalsFold(s2b(req.Header.Get(":protocol")), websocketString)
+}
+
+// upgradeH2 upgrades an HTTP/2 extended CONNECT stream.
+//
+// The stream ends when the handler returns, so the
+// connection must be served in the handler's goroutine.
+//
+// net/http only accepts extended CONNECT requests if GODEBUG contains http2xconnect=1.
+func (u *Upgrader) upgradeH2(resp http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if !u.checkNetOrigin(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return nil, ErrOriginNotAllowed
+	}
+
+	hprotos, err := u.acceptNet(resp, req)
+	if err != nil {
+		return nil, err
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return nil, ErrCannotUpgrade
+	}
+
+	proto := u.selectProtocol(hprotos)
+	if proto != "" {
+		resp.Header().Set(b2s(wsHeaderProtocol), proto)
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := &h2Conn{
+		r:     req.Body,
+		w:     resp,
+		flush: flusher.Flush,
+		raddr: h2Addr(req.RemoteAddr),
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.laddr = addr
+	}
+	if dl, ok := resp.(h2Deadliner); ok {
+		c.dl = dl
+	}
+
+	return newNetConn(c, c, req, proto), nil
+}
+
+// DialH2 establishes a websocket connection as client over an HTTP/2
+// stream using the extended CONNECT method (RFC 8441).
+//
+// rt performs the request and must support the extended CONNECT protocol,
+// like the net/http Transport does over HTTP/2. Dialing with the same rt
+// multiplexes the connections on the same HTTP/2 connection.
+//
+// url parameter must follow the WebSocket URL format i.e. wss://host:port/path
+func DialH2(url string, rt http.RoundTripper) (*Client, error) {
+	return dialH2(url, rt, nil)
+}
+
+// DialH2WithHeaders is like DialH2 but sending a personalized request.
+func DialH2WithHeaders(url string, rt http.RoundTripper, req *fasthttp.Request) (*Client, error) {
+	return dialH2(url, rt, req)
+}
+
+func dialH2(url string, rt http.RoundTripper, r *fasthttp.Request) (*Client, error) {
+	switch {
+	case strings.HasPrefix(url, "wss://"):
+		url = "https://" + url[6:]
+	case strings.HasPrefix(url, "ws://"):
+		url = "http://" + url[5:]
+	}
+
+	c := &h2Conn{}
+
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.laddr = info.Conn.LocalAddr()
+			c.raddr = info.Conn.RemoteAddr()
+		},
+	})
+
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, url, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	if r != nil {
+		r.Header.VisitAll(func(k, v []byte) {
+			req.Header.Add(string(k), string(v))
+		})
+	}
+
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set(b2s(wsHeaderVersion), b2s(supportedVersions[0]))
+
+	uri := fasthttp.AcquireURI()
+	uri.Update(url)
+	origin := prepareOrigin(nil, uri)
+	fasthttp.ReleaseURI(uri)
+
+	req.Header.Set(b2s(originString), b2s(origin))
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		pw.Close()
+		return nil, ErrCannotUpgrade
+	}
+
+	c.r = res.Body
+	c.w = pw
+	c.closeWriter = pw.Close
+
+	return &Client{
+		c: c,
+		brw: bufio.NewReadWriter(
+			bufio.NewReader(c), bufio.NewWriter(c)),
+		proto: res.Header.Get(b2s(wsHeaderProtocol)),
+	}, nil
+}
+
+type h2Deadliner interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// h2Conn adapts an HTTP/2 stream to net.Conn.
+type h2Conn struct {
+	r     io.ReadCloser
+	w     io.Writer
+	flush func()
+
+	closeWriter func() error
+
+	dl           h2Deadliner
+	laddr, raddr net.Addr
+
+	once sync.Once
+}
+
+var _ net.Conn = (*h2Conn)(nil)
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil && c.flush != nil {
+		c.flush()
+	}
+
+	return n, err
+}
+
+func (c *h2Conn) Close() (err error) {
+	c.once.Do(func() {
+		if c.closeWriter != nil {
+			err = c.closeWriter()
+		}
+
+		if rerr := c.r.Close(); err == nil {
+			err = rerr
+		}
+	})
+
+	return err
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	if c.dl == nil {
+		return os.ErrNoDeadline
+	}
+
+	return c.dl.SetReadDeadline(t)
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	if c.dl == nil {
+		return os.ErrNoDeadline
+	}
+
+	return c.dl.SetWriteDeadline(t)
+}
+
+// h2Addr is the address of the peer as reported by net/http.
+type h2Addr string
+
+func (addr h2Addr) Network() string {
+	return "tcp"
+}
+
+func (addr h2Addr) String() string {
+	return string(addr)
+}
@@ -0,0 +1,19 @@
+module http2test
+
+go 1.21
+
+require (
+	github.com/valyala/fasthttp v1.40.0
+	github.com/xenking/websocket v1.0.0
+	golang.org/x/net v0.35.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/xenking/bytebufferpool v1.1.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
+
+replace github.com/xenking/websocket => ../
@@ -0,0 +1,101 @@
+// Package http2test tests the websockets over HTTP/2 apart
+// keeping golang.org/x/net out of the websocket module.
+package http2test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xenking/websocket"
+	"golang.org/x/net/http2"
+)
+
+// the extended CONNECT protocol is disabled in net/http by default
+// and the setting is read once at init.
+func requireExtendedConnect(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Skip("run with GODEBUG=http2xconnect=1")
+	}
+}
+
+func TestNetUpgradeH2(t *testing.T) {
+	requireExtendedConnect(t)
+
+	text := "Hello over h2"
+	closed := make(chan websocket.CloseInfo, 1)
+
+	ws := websocket.Server{
+		Protocols: []string{"chat"},
+	}
+	ws.HandleData(func(c *websocket.Conn, isBinary bool, data []byte) {
+		if c.RemoteAddr() == nil {
+			t.Error("missing remote address")
+		}
+		if p := c.Subprotocol(); p != "chat" {
+			t.Errorf("unexpected subprotocol: %s", p)
+		}
+
+		c.Write(data)
+	})
+	ws.HandleClose(func(c *websocket.Conn, info websocket.CloseInfo) {
+		closed <- info
+	})
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(ws.NetUpgrade))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	rt := &http2.Transport{
+		TLSClientConfig: s.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+
+	conn, err := websocket.DialH2WithHeaders("wss"+strings.TrimPrefix(s.URL, "https")+"/chat?room=1", rt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = conn.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := websocket.AcquireFrame()
+	defer websocket.ReleaseFrame(fr)
+
+	if _, err = conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if string(fr.Payload()) != text {
+		t.Fatalf("%s <> %s", fr.Payload(), text)
+	}
+
+	fr.Reset()
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(websocket.StatusGoAway)
+	fr.Mask()
+	if _, err = conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case info := <-closed:
+		if info.Status != websocket.StatusGoAway || !info.Remote {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+}
@@ -2,12 +2,35 @@ package websocket
 
 import (
 	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
 )
 
+// mask XORs b with the mask key.
 func mask(mask, b []byte) {
+	maskAt(mask, b, 0)
+}
+
+// maskAt masks b as the bytes found at position pos of the payload
+// returning the position following b.
+//
+// Thus a payload can be masked in chunks passing the returned position along.
+func maskAt(mask, b []byte, pos int) int {
+	n := pos + len(b)
+
+	// the key rotated to start at pos
+	key := bits.RotateLeft32(binary.LittleEndian.Uint32(mask), -8*(pos&3))
+
+	if len(b) >= 8 {
+		b = b[maskWords(uint64(key)<<32|uint64(key), b):]
+	}
+
 	for i := range b {
-		b[i] ^= mask[i&3]
+		b[i] ^= byte(key)
+		key = bits.RotateLeft32(key, -8)
 	}
+
+	return n
 }
 
 func readMask(b []byte) {
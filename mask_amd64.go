@@ -0,0 +1,9 @@
+//go:build !purego
+
+package websocket
+
+// maskWords masks b 64 bytes at a time using SSE2, then 8 bytes at a time,
+// returning the number of bytes masked.
+//
+//go:noescape
+func maskWords(key uint64, b []byte) int
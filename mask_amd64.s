@@ -0,0 +1,50 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func maskWords(key uint64, b []byte) int
+TEXT ·maskWords(SB), NOSPLIT, $0-40
+	MOVQ key+0(FP), AX
+	MOVQ b_base+8(FP), SI
+	MOVQ b_len+16(FP), CX
+
+	MOVQ CX, DX
+	ANDQ $-8, DX
+	MOVQ DX, ret+32(FP)
+
+	MOVQ       AX, X0
+	PUNPCKLQDQ X0, X0
+
+loop64:
+	CMPQ CX, $64
+	JB   loop8
+
+	MOVOU 0(SI), X1
+	MOVOU 16(SI), X2
+	MOVOU 32(SI), X3
+	MOVOU 48(SI), X4
+	PXOR  X0, X1
+	PXOR  X0, X2
+	PXOR  X0, X3
+	PXOR  X0, X4
+	MOVOU X1, 0(SI)
+	MOVOU X2, 16(SI)
+	MOVOU X3, 32(SI)
+	MOVOU X4, 48(SI)
+
+	ADDQ $64, SI
+	SUBQ $64, CX
+	JMP  loop64
+
+loop8:
+	CMPQ CX, $8
+	JB   done
+
+	XORQ AX, 0(SI)
+
+	ADDQ $8, SI
+	SUBQ $8, CX
+	JMP  loop8
+
+done:
+	RET
@@ -0,0 +1,25 @@
+//go:build !amd64 || purego
+
+package websocket
+
+import "encoding/binary"
+
+// maskWords masks b 8 bytes at a time returning the number of bytes masked.
+func maskWords(key uint64, b []byte) int {
+	n := len(b) &^ 7
+
+	for len(b) >= 32 {
+		binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^key)
+		binary.LittleEndian.PutUint64(b[8:], binary.LittleEndian.Uint64(b[8:])^key)
+		binary.LittleEndian.PutUint64(b[16:], binary.LittleEndian.Uint64(b[16:])^key)
+		binary.LittleEndian.PutUint64(b[24:], binary.LittleEndian.Uint64(b[24:])^key)
+		b = b[32:]
+	}
+
+	for len(b) >= 8 {
+		binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^key)
+		b = b[8:]
+	}
+
+	return n
+}
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -19,3 +20,90 @@ func TestUnmask(t *testing.T) {
 		t.Fatalf("%v <> %s", m, unmasked)
 	}
 }
+
+// maskBytes is the reference implementation masking b byte by byte.
+func maskBytes(mask, b []byte, pos int) {
+	for i := range b {
+		b[i] ^= mask[(pos+i)&3]
+	}
+}
+
+func TestMaskAt(t *testing.T) {
+	key := []byte{12, 96, 138, 48}
+
+	payload := make([]byte, 300)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	for size := 0; size < len(payload); size++ {
+		for pos := 0; pos < 4; pos++ {
+			expected := append([]byte(nil), payload[:size]...)
+			maskBytes(key, expected, pos)
+
+			// unaligned slices
+			b := append([]byte{0}, payload[:size]...)[1:]
+			if n := maskAt(key, b, pos); n != pos+size {
+				t.Fatalf("unexpected position %d", n)
+			}
+
+			if !bytes.Equal(b, expected) {
+				t.Fatalf("size %d pos %d: %v <> %v", size, pos, b, expected)
+			}
+		}
+	}
+}
+
+func TestMaskChunks(t *testing.T) {
+	key := []byte{12, 96, 138, 48}
+
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	expected := append([]byte(nil), payload...)
+	maskBytes(key, expected, 0)
+
+	for _, chunk := range []int{1, 3, 7, 8, 13, 33, 100} {
+		b := append([]byte(nil), payload...)
+
+		pos := 0
+		for pos < len(b) {
+			end := pos + chunk
+			if end > len(b) {
+				end = len(b)
+			}
+
+			pos = maskAt(key, b[pos:end], pos)
+		}
+
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("unexpected payload masking chunks of %d bytes", chunk)
+		}
+	}
+}
+
+func benchmarkMask(b *testing.B, size int, fn func(key, b []byte)) {
+	key := []byte{12, 96, 138, 48}
+	payload := make([]byte, size)
+
+	b.SetBytes(int64(size))
+
+	for i := 0; i < b.N; i++ {
+		fn(key, payload)
+	}
+}
+
+func BenchmarkMask(b *testing.B) {
+	for _, size := range []int{15, 128, 1 << 10, 16 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("bytes/%d", size), func(b *testing.B) {
+			benchmarkMask(b, size, func(key, b []byte) {
+				maskBytes(key, b, 0)
+			})
+		})
+		b.Run(fmt.Sprintf("mask/%d", size), func(b *testing.B) {
+			benchmarkMask(b, size, mask)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+)
+
+// messageReader reads the payload of a message spanning multiple frames.
+type messageReader struct {
+	fr  *Frame
+	off int
+	err error
+
+	// next returns the next continuation frame of the message.
+	next func() (*Frame, error)
+}
+
+func (mr *messageReader) Read(b []byte) (int, error) {
+	for {
+		if mr.err != nil {
+			return 0, mr.err
+		}
+
+		if p := mr.fr.Payload(); mr.off < len(p) {
+			n := copy(b, p[mr.off:])
+			mr.off += n
+
+			return n, nil
+		}
+
+		fin := mr.fr.IsFin()
+
+		ReleaseFrame(mr.fr)
+		mr.fr, mr.off = nil, 0
+
+		if fin {
+			mr.err = io.EOF
+			continue
+		}
+
+		mr.fr, mr.err = mr.next()
+	}
+}
+
+var errWriterClosed = errors.New("message writer closed")
+
+// messageWriter writes a message fragmenting it in frames of size bytes.
+type messageWriter struct {
+	fr   *Frame
+	size int
+	err  error
+
+	// flush writes fr returning the frame to fill next.
+	flush func(fr *Frame) (*Frame, error)
+	// release is called once the writer is closed or fails.
+	release func()
+}
+
+// done calls release once.
+func (mw *messageWriter) done() {
+	if mw.release != nil {
+		mw.release()
+		mw.release = nil
+	}
+}
+
+func (mw *messageWriter) Write(b []byte) (int, error) {
+	if mw.err != nil {
+		return 0, mw.err
+	}
+
+	size := mw.size
+	if size <= 0 {
+		size = DefaultFragmentSize
+	}
+
+	n := 0
+
+	for len(b) > 0 {
+		m := size - mw.fr.PayloadLen()
+		if m > len(b) {
+			m = len(b)
+		}
+
+		mw.fr.Write(b[:m])
+		b = b[m:]
+		n += m
+
+		if mw.fr.PayloadLen() == size {
+			mw.fr, mw.err = mw.flush(mw.fr)
+			if mw.err != nil {
+				// the message cannot be completed
+				mw.done()
+				return n, mw.err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close sends the last frame of the message.
+func (mw *messageWriter) Close() error {
+	if mw.err == errWriterClosed {
+		return mw.err
+	}
+
+	err := mw.err
+	if err == nil {
+		mw.fr.SetFin()
+
+		var fr *Frame
+
+		fr, err = mw.flush(mw.fr)
+		if fr != nil {
+			ReleaseFrame(fr)
+		}
+	}
+
+	mw.fr = nil
+	mw.err = errWriterClosed
+
+	mw.done()
+
+	return err
+}
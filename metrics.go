@@ -0,0 +1,330 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects the metrics of the connections.
+//
+// The methods are called by the goroutines serving the connections,
+// thus they must be safe for concurrent use and must not block.
+type Metrics interface {
+	// UpgradeAccepted is called once a connection has been upgraded.
+	UpgradeAccepted()
+	// UpgradeRejected is called when an upgrade fails with the error returned
+	// by the Upgrader (i.e. ErrOriginNotAllowed or ErrUpgradeRejected).
+	UpgradeRejected(err error)
+	// ConnOpened is called once a connection starts being served.
+	ConnOpened()
+	// ConnClosed is called once a connection has been closed,
+	// before the CloseHandler runs.
+	ConnClosed(info CloseInfo)
+	// FrameRead is called for each frame read, n being the size of the frame.
+	FrameRead(code Code, n int)
+	// FrameWritten is called for each frame written, n being the size of the frame.
+	FrameWritten(code Code, n int)
+	// WriteDone is called once a batch of frames has been written
+	// with the number of frames still queued and the time spent writing.
+	WriteDone(queued int, d time.Duration)
+	// Error is called with the I/O and protocol errors ending a connection.
+	Error(err error)
+}
+
+// PrometheusMetrics is a Metrics counting the events which exposes the
+// counters in the Prometheus text exposition format when served over HTTP.
+//
+// The zero PrometheusMetrics is ready to use.
+type PrometheusMetrics struct {
+	// Namespace prefixes the metric names, "websocket" if empty.
+	Namespace string
+
+	accepted uint64
+	active   int64
+
+	framesIn  [16]uint64
+	bytesIn   [16]uint64
+	framesOut [16]uint64
+	bytesOut  [16]uint64
+
+	writeLatency histogram
+	queueDepth   histogram
+
+	// mu guards the counters labeled with the reasons and the close statuses.
+	mu       sync.Mutex
+	rejected map[string]uint64
+	closed   map[string]uint64
+	errors   map[string]uint64
+}
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+var (
+	writeLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+	queueDepthBuckets   = []float64{0, 1, 4, 16, 64, 128}
+)
+
+// UpgradeAccepted implements Metrics.
+func (m *PrometheusMetrics) UpgradeAccepted() {
+	atomic.AddUint64(&m.accepted, 1)
+}
+
+// UpgradeRejected implements Metrics.
+func (m *PrometheusMetrics) UpgradeRejected(err error) {
+	m.inc(&m.rejected, rejectReason(err))
+}
+
+// ConnOpened implements Metrics.
+func (m *PrometheusMetrics) ConnOpened() {
+	atomic.AddInt64(&m.active, 1)
+}
+
+// ConnClosed implements Metrics.
+func (m *PrometheusMetrics) ConnClosed(info CloseInfo) {
+	atomic.AddInt64(&m.active, -1)
+
+	// the statuses reserved for the closures without status
+	status := info.Status
+	if status == 0 {
+		status = 1005
+		if info.Err != nil {
+			status = 1006
+		}
+	}
+
+	m.inc(&m.closed, strconv.Itoa(int(status)))
+}
+
+// FrameRead implements Metrics.
+func (m *PrometheusMetrics) FrameRead(code Code, n int) {
+	atomic.AddUint64(&m.framesIn[code&0xf], 1)
+	atomic.AddUint64(&m.bytesIn[code&0xf], uint64(n))
+}
+
+// FrameWritten implements Metrics.
+func (m *PrometheusMetrics) FrameWritten(code Code, n int) {
+	atomic.AddUint64(&m.framesOut[code&0xf], 1)
+	atomic.AddUint64(&m.bytesOut[code&0xf], uint64(n))
+}
+
+// WriteDone implements Metrics.
+func (m *PrometheusMetrics) WriteDone(queued int, d time.Duration) {
+	m.writeLatency.observe(writeLatencyBuckets, d.Seconds())
+	m.queueDepth.observe(queueDepthBuckets, float64(queued))
+}
+
+// Error implements Metrics.
+func (m *PrometheusMetrics) Error(err error) {
+	m.inc(&m.errors, errorKind(err))
+}
+
+func (m *PrometheusMetrics) inc(counters *map[string]uint64, label string) {
+	m.mu.Lock()
+	if *counters == nil {
+		*counters = make(map[string]uint64)
+	}
+	(*counters)[label]++
+	m.mu.Unlock()
+}
+
+// rejectReason returns the label of the upgrade error.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrOriginNotAllowed):
+		return "origin"
+	case errors.Is(err, ErrVersionNotSupported):
+		return "version"
+	case errors.Is(err, ErrUpgradeRejected):
+		return "rejected"
+	case errors.Is(err, ErrCannotUpgrade):
+		return "bad_request"
+	}
+
+	return "other"
+}
+
+// errorKind returns the label of the connection error.
+func errorKind(err error) string {
+	var ne net.Error
+
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, ErrFrameTooBig):
+		return "too_big"
+	case errors.Is(err, ErrReservedBits), errors.Is(err, ErrInvalidCode),
+		errors.Is(err, ErrControlTooBig), errors.Is(err, ErrFragmentedControl),
+		errors.Is(err, ErrInvalidLength), errors.Is(err, ErrUnmaskedFrame),
+		errors.Is(err, ErrMaskedFrame):
+		return "protocol"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+
+	return "other"
+}
+
+// opcodeLabel returns the label of the frame opcode.
+func opcodeLabel(code Code) string {
+	if s := code.String(); s != "" {
+		return strings.ToLower(s)
+	}
+
+	return strconv.Itoa(int(code))
+}
+
+// ServeHTTP writes the counters in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.WriteTo(w)
+}
+
+// WriteTo writes the counters in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	ns := m.Namespace
+	if ns == "" {
+		ns = "websocket"
+	}
+
+	var b []byte
+
+	b = appendMetric(b, ns+"_upgrades_accepted_total", "counter",
+		"Number of connections upgraded.", "", float64(atomic.LoadUint64(&m.accepted)))
+
+	m.mu.Lock()
+	b = appendLabeled(b, ns+"_upgrades_rejected_total",
+		"Number of upgrades rejected by reason.", "reason", m.rejected)
+	b = appendLabeled(b, ns+"_connections_closed_total",
+		"Number of connections closed by close status.", "status", m.closed)
+	b = appendLabeled(b, ns+"_errors_total",
+		"Number of errors ending the connections by kind.", "kind", m.errors)
+	m.mu.Unlock()
+
+	b = appendMetric(b, ns+"_connections_active", "gauge",
+		"Number of connections being served.", "", float64(atomic.LoadInt64(&m.active)))
+
+	b = appendOpcodes(b, ns+"_frames_received_total", "Number of frames read by opcode.", &m.framesIn)
+	b = appendOpcodes(b, ns+"_received_bytes_total", "Number of bytes read by opcode.", &m.bytesIn)
+	b = appendOpcodes(b, ns+"_frames_sent_total", "Number of frames written by opcode.", &m.framesOut)
+	b = appendOpcodes(b, ns+"_sent_bytes_total", "Number of bytes written by opcode.", &m.bytesOut)
+
+	b = m.writeLatency.append(b, ns+"_write_duration_seconds",
+		"Time spent writing the batches of frames.", writeLatencyBuckets)
+	b = m.queueDepth.append(b, ns+"_write_queue_depth",
+		"Number of frames queued once a batch has been written.", queueDepthBuckets)
+
+	n, err := w.Write(b)
+
+	return int64(n), err
+}
+
+func appendMetricHeader(b []byte, name, typ, help string) []byte {
+	return fmt.Appendf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func appendMetric(b []byte, name, typ, help, labels string, v float64) []byte {
+	b = appendMetricHeader(b, name, typ, help)
+
+	return appendSample(b, name, labels, v)
+}
+
+func appendSample(b []byte, name, labels string, v float64) []byte {
+	b = append(b, name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, v, 'g', -1, 64)
+
+	return append(b, '\n')
+}
+
+func appendLabeled(b []byte, name, help, label string, counters map[string]uint64) []byte {
+	b = appendMetricHeader(b, name, "counter", help)
+
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b = appendSample(b, name, label+"="+strconv.Quote(k), float64(counters[k]))
+	}
+
+	return b
+}
+
+func appendOpcodes(b []byte, name, help string, counters *[16]uint64) []byte {
+	b = appendMetricHeader(b, name, "counter", help)
+
+	for code := range counters {
+		if v := atomic.LoadUint64(&counters[code]); v != 0 {
+			b = appendSample(b, name, `opcode="`+opcodeLabel(Code(code))+`"`, float64(v))
+		}
+	}
+
+	return b
+}
+
+// histogram counts the observations falling into up to 16 buckets.
+type histogram struct {
+	// counts holds the observations of each bucket, not cumulated.
+	counts [16]uint64
+	count  uint64
+	// sum holds the bits of the float64 sum.
+	sum uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	// counted first so the count is never lower than the buckets
+	atomic.AddUint64(&h.count, 1)
+
+	for i, le := range buckets {
+		if v <= le {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) append(b []byte, name, help string, buckets []float64) []byte {
+	b = appendMetricHeader(b, name, "histogram", help)
+
+	var cumulated uint64
+	for i, le := range buckets {
+		cumulated += atomic.LoadUint64(&h.counts[i])
+
+		b = appendSample(b, name+"_bucket",
+			`le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, float64(cumulated))
+	}
+
+	count := atomic.LoadUint64(&h.count)
+
+	b = appendSample(b, name+"_bucket", `le="+Inf"`, float64(count))
+	b = appendSample(b, name+"_sum", "", math.Float64frombits(atomic.LoadUint64(&h.sum)))
+
+	return appendSample(b, name+"_count", "", float64(count))
+}
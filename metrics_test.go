@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// metricValue returns the value of the sample `name` exposed by m.
+func metricValue(t *testing.T, m *PrometheusMetrics, name string) float64 {
+	t.Helper()
+
+	var bf bytes.Buffer
+	m.WriteTo(&bf)
+
+	sc := bufio.NewScanner(&bf)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(line[len(name)+1:], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return v
+	}
+
+	return 0
+}
+
+func TestServerMetrics(t *testing.T) {
+	var (
+		m      PrometheusMetrics
+		closed = make(chan CloseInfo, 1)
+	)
+
+	ws := Server{
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			return string(ctx.Path()) != "/private"
+		},
+		Metrics: &m,
+	}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- info
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRejectResponse(t, doHandshake(t, c, "/private"), fasthttp.StatusForbidden, "")
+	c.Close()
+
+	var cm PrometheusMetrics
+
+	for _, shutdown := range []bool{false, true} {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := MakeClient(c, "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Metrics = &cm
+
+		io.WriteString(conn, "hello")
+		if _, _, err := conn.ReadMessage(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if shutdown {
+			conn.Shutdown()
+		} else {
+			conn.Close()
+		}
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	for name, expected := range map[string]float64{
+		`websocket_upgrades_accepted_total`:                       2,
+		`websocket_upgrades_rejected_total{reason="rejected"}`:    1,
+		`websocket_connections_active`:                            0,
+		`websocket_connections_closed_total{status="1000"}`:       1,
+		`websocket_connections_closed_total{status="1006"}`:       1,
+		`websocket_errors_total{kind="eof"}`:                      1,
+		`websocket_frames_received_total{opcode="text"}`:          2,
+		`websocket_received_bytes_total{opcode="text"}`:           22,
+		`websocket_frames_sent_total{opcode="text"}`:              2,
+		`websocket_sent_bytes_total{opcode="text"}`:               14,
+		`websocket_write_queue_depth_bucket{le="+Inf"}`:           metricValue(t, &m, "websocket_write_duration_seconds_count"),
+		`websocket_frames_received_total{opcode="close"}`:         1,
+		`websocket_write_duration_seconds_count`:                  -1,
+		`websocket_write_queue_depth_bucket{le="128"}`:            -1,
+		`websocket_upgrades_rejected_total{reason="bad_request"}`: 0,
+	} {
+		v := metricValue(t, &m, name)
+		if expected < 0 {
+			if v <= 0 {
+				t.Errorf("%s not reported", name)
+			}
+
+			continue
+		}
+
+		if v != expected {
+			t.Errorf("%s: %v <> %v", name, v, expected)
+		}
+	}
+
+	// the client reports the frames too
+	for name, expected := range map[string]float64{
+		`websocket_frames_sent_total{opcode="text"}`:      2,
+		`websocket_frames_sent_total{opcode="close"}`:     1,
+		`websocket_frames_received_total{opcode="text"}`:  2,
+		`websocket_received_bytes_total{opcode="text"}`:   14,
+		`websocket_write_queue_depth_bucket{le="+Inf"}`:   2,
+		`websocket_frames_received_total{opcode="close"}`: 0,
+	} {
+		if v := metricValue(t, &cm, name); v != expected {
+			t.Errorf("client %s: %v <> %v", name, v, expected)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE websocket_connections_active gauge\n") {
+		t.Fatalf("unexpected exposition:\n%s", rec.Body)
+	}
+}
+
+func TestMetricsErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind string
+	}{
+		{io.EOF, "eof"},
+		{ErrTruncatedFrame, "eof"},
+		{net.ErrClosed, "closed"},
+		{ErrFrameTooBig, "too_big"},
+		{fmt.Errorf("reading: %w", ErrReservedBits), "protocol"},
+		{os.ErrDeadlineExceeded, "timeout"},
+		{errors.New("unknown"), "other"},
+	} {
+		if kind := errorKind(tc.err); kind != tc.kind {
+			t.Errorf("%v: %s <> %s", tc.err, kind, tc.kind)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetConn returns a net.Conn reading and writing over the WebSocket connection c.
+//
+// Read spans the data messages received from the peer and Write sends binary messages.
+// The read deadline is handled by the adapter, thus the reads can be resumed
+// once it's exceeded, while the write deadline is set on the underlying connection.
+// Close performs the closing handshake.
+//
+// c must be a connection returned by the Upgrader, given that the connections
+// served by the Server are read by the Server itself.
+func NetConn(c *Conn) net.Conn {
+	return newNetConnAdapter(c.c,
+		func() (io.Reader, error) {
+			_, r, err := c.NextReader(context.Background())
+			return r, err
+		},
+		func(b []byte) (int, error) {
+			if atomic.LoadInt32(&c.closed) == 1 {
+				return 0, net.ErrClosed
+			}
+
+			if len(b) == 0 {
+				return 0, nil
+			}
+
+			fr := AcquireFrame()
+			fr.SetBinary()
+			fr.SetFin()
+			fr.SetPayload(b)
+
+			c.WriteFrame(fr)
+
+			return len(b), nil
+		},
+		c.Close,
+	)
+}
+
+// NetClientConn is like NetConn but for clients.
+func NetClientConn(c *Client) net.Conn {
+	return newNetConnAdapter(c.c,
+		func() (io.Reader, error) {
+			_, r, err := c.NextReader()
+			return r, err
+		},
+		func(b []byte) (int, error) {
+			if len(b) == 0 {
+				return 0, nil
+			}
+
+			return c.WriteBinary(b)
+		},
+		c.Close,
+	)
+}
+
+// netConnBufferSize is the size of the buffer the messages are read into.
+const netConnBufferSize = 32 << 10
+
+// netConn adapts a WebSocket connection to net.Conn.
+//
+// The messages are read by a goroutine, so a read deadline exceeded
+// doesn't interrupt the reading of a frame.
+type netConn struct {
+	c net.Conn
+	r io.Reader
+
+	nextReader func() (io.Reader, error)
+	write      func(b []byte) (int, error)
+	close      func() error
+
+	// rmu serialises the reads.
+	rmu     sync.Mutex
+	start   sync.Once
+	results chan netConnRead
+	next    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+
+	// res holds the data read not returned yet.
+	res    netConnRead
+	hasRes bool
+
+	readDeadline deadline
+}
+
+// netConnRead is the result of a read performed by the reading goroutine.
+type netConnRead struct {
+	b   []byte
+	err error
+}
+
+var _ net.Conn = (*netConn)(nil)
+
+func newNetConnAdapter(c net.Conn, nextReader func() (io.Reader, error),
+	write func(b []byte) (int, error), close func() error,
+) *netConn {
+	return &netConn{
+		c:          c,
+		nextReader: nextReader,
+		write:      write,
+		close:      close,
+		results:    make(chan netConnRead, 1),
+		next:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (nc *netConn) Read(b []byte) (int, error) {
+	nc.rmu.Lock()
+	defer nc.rmu.Unlock()
+
+	select {
+	case <-nc.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	nc.start.Do(func() {
+		go nc.readLoop()
+	})
+
+	if !nc.hasRes {
+		select {
+		case nc.res = <-nc.results:
+			nc.hasRes = true
+		case <-nc.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-nc.done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(b, nc.res.b)
+	nc.res.b = nc.res.b[n:]
+
+	// the read error is returned once the data read has been returned
+	if len(nc.res.b) != 0 || nc.res.err != nil {
+		if n != 0 {
+			return n, nil
+		}
+
+		return 0, nc.res.err
+	}
+
+	// the reading goroutine exits once closed
+	nc.hasRes = false
+	select {
+	case nc.next <- struct{}{}:
+	case <-nc.done:
+	}
+
+	return n, nil
+}
+
+// readLoop reads the messages handing the data read over to Read.
+func (nc *netConn) readLoop() {
+	buf := make([]byte, netConnBufferSize)
+
+	for {
+		n, err := nc.read(buf)
+		nc.results <- netConnRead{buf[:n], err}
+
+		if err != nil {
+			return
+		}
+
+		// wait for the data to be consumed
+		select {
+		case <-nc.next:
+		case <-nc.done:
+			return
+		}
+	}
+}
+
+// read reads the data of the messages into b.
+func (nc *netConn) read(b []byte) (int, error) {
+	for {
+		if nc.r == nil {
+			r, err := nc.nextReader()
+			if err != nil {
+				return 0, netConnError(err)
+			}
+
+			nc.r = r
+		}
+
+		n, err := nc.r.Read(b)
+		if errors.Is(err, io.EOF) {
+			nc.r, err = nil, nil
+			if n == 0 {
+				continue
+			}
+		}
+
+		return n, netConnError(err)
+	}
+}
+
+// netConnError reports a normal closure as io.EOF.
+func netConnError(err error) error {
+	if e := (Error{}); errors.As(err, &e) &&
+		(e.Status == StatusNone || e.Status == StatusGoAway) {
+		return io.EOF
+	}
+
+	return err
+}
+
+func (nc *netConn) Write(b []byte) (int, error) {
+	return nc.write(b)
+}
+
+func (nc *netConn) Close() error {
+	nc.closing.Do(func() {
+		close(nc.done)
+	})
+
+	return nc.close()
+}
+
+func (nc *netConn) LocalAddr() net.Addr {
+	return nc.c.LocalAddr()
+}
+
+func (nc *netConn) RemoteAddr() net.Addr {
+	return nc.c.RemoteAddr()
+}
+
+func (nc *netConn) SetDeadline(t time.Time) error {
+	nc.readDeadline.set(t)
+
+	return nc.c.SetWriteDeadline(t)
+}
+
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	nc.readDeadline.set(t)
+
+	return nil
+}
+
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	return nc.c.SetWriteDeadline(t)
+}
+
+// deadline is a channel closed once the deadline set is exceeded.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	done   chan struct{}
+	closed bool
+}
+
+// set sets the deadline, a zero t meaning no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// a timer already fired has closed the channel
+	if d.timer != nil && !d.timer.Stop() {
+		d.closed = true
+	}
+	d.timer = nil
+
+	if d.done == nil || d.closed {
+		d.done = make(chan struct{})
+		d.closed = false
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.done)
+		d.closed = true
+
+		return
+	}
+
+	done := d.done
+	d.timer = time.AfterFunc(dur, func() {
+		close(done)
+	})
+}
+
+// wait returns the channel closed once the deadline is exceeded.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.done == nil {
+		d.done = make(chan struct{})
+	}
+
+	return d.done
+}
@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetConnTunnel(t *testing.T) {
+	u := Upgrader{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.UpgradeHTTP(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		nc := NetConn(c)
+		defer nc.Close()
+
+		// echo the stream back
+		io.Copy(nc, nc)
+	}))
+	defer s.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc := NetClientConn(conn)
+	defer nc.Close()
+
+	payload := bytes.Repeat([]byte("tunneled stream "), 1024)
+
+	go func() {
+		for i := 0; i < len(payload); i += 1000 {
+			end := i + 1000
+			if end > len(payload) {
+				end = len(payload)
+			}
+
+			if _, err := nc.Write(payload[i:end]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	b := make([]byte, len(payload))
+	if _, err = io.ReadFull(nc, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatal("unexpected payload")
+	}
+
+	nc.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, err = nc.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the reads resume once the deadline has been exceeded
+	nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := io.WriteString(nc, "resumed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(nc, b[:7]); err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:7]) != "resumed" {
+		t.Fatalf("unexpected data: %s", b[:7])
+	}
+}
+
+func TestNetConnEOF(t *testing.T) {
+	u := Upgrader{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.UpgradeHTTP(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		nc := NetConn(c)
+		io.WriteString(nc, "bye")
+		nc.Close()
+
+		if _, err := io.WriteString(nc, "closed"); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}))
+	defer s.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc := NetClientConn(conn)
+	defer nc.Close()
+
+	nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	b, err := io.ReadAll(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bye" {
+		t.Fatalf("unexpected data: %s", b)
+	}
+}
+
+func TestNetConnReadClosed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// the second message never comes
+	readers := make(chan io.Reader, 1)
+	readers <- strings.NewReader("message")
+
+	nc := newNetConnAdapter(c1, func() (io.Reader, error) {
+		return <-readers, nil
+	}, c1.Write, c1.Close)
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(nc, b); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := nc.Read(b); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,570 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrNetpollUnsupported is returned by EnableNetpoll when the
+// platform doesn't support the netpoll mode.
+var ErrNetpollUnsupported = errors.New("netpoll mode is not supported on this platform")
+
+var (
+	// errNetpollStopped is returned arming a connection once StopNetpoll has been called.
+	errNetpollStopped = errors.New("netpoll mode stopped")
+	// errWouldBlock is returned reading a connection with no data available.
+	errWouldBlock = errors.New("no data available")
+)
+
+// DefaultNetpollWorkers defines the default number of workers
+// handling the frames in netpoll mode (when none was defined).
+const DefaultNetpollWorkers = 256
+
+// EnableNetpoll serves the connections using an epoll event loop (Linux only)
+// instead of running goroutines for every connection.
+//
+// An idle connection holds no goroutine and no read buffer. The frames are read
+// without blocking once the connection becomes readable, the incomplete frames
+// being kept until the rest is received, and the handlers run on a pool of workers
+// goroutines. A connection is served by one worker at a time, thus its frames are
+// handled in order but a blocking handler keeps the worker busy, as does
+// a StreamHandler waiting for the next frame of the message (see Conn.ReadTimeout).
+// Once all the workers are busy, the readable connections wait for a worker to be available.
+// The writes are performed by the goroutine writing the frame, which is blocked
+// until the frame is written. The CloseHandler runs on a worker, thus a connection
+// can be written or closed holding a lock the CloseHandler takes.
+//
+// Only plain TCP connections are polled, the rest (i.e. TLS or HTTP/2 streams) are served as usual.
+//
+// EnableNetpoll must be called before upgrading any connection.
+func (s *Server) EnableNetpoll(workers int) error {
+	if workers <= 0 {
+		workers = DefaultNetpollWorkers
+	}
+
+	ep, err := newEpoller()
+	if err != nil {
+		return err
+	}
+
+	np := &netpoll{
+		s:  s,
+		ep: ep,
+	}
+	np.cond.L = &np.mu
+
+	for i := 0; i < workers; i++ {
+		go np.work()
+	}
+
+	go func() {
+		ep.wait(np.dispatch)
+
+		// stop the workers once the queued connections are served
+		np.mu.Lock()
+		np.closing = true
+		np.mu.Unlock()
+
+		np.cond.Broadcast()
+	}()
+
+	s.poller = np
+
+	return nil
+}
+
+// StopNetpoll stops the event loop and the workers started by EnableNetpoll
+// closing the connections served in netpoll mode with StatusGoAway.
+//
+// The connections upgraded afterwards are served as usual.
+func (s *Server) StopNetpoll() {
+	np := s.poller
+	if np == nil || !atomic.CompareAndSwapInt32(&np.stopped, 0, 1) {
+		return
+	}
+
+	for _, c := range np.ep.close() {
+		c.CloseDetail(StatusGoAway, "")
+	}
+}
+
+// netpoll dispatches the readable connections to the workers.
+type netpoll struct {
+	s       *Server
+	ep      *epoller
+	stopped int32
+
+	// ready queues the readable connections until a worker is available.
+	//
+	// The connections are polled as one-shot, thus every connection
+	// is queued once at most while waiting to be readable.
+	mu      sync.Mutex
+	cond    sync.Cond
+	ready   []*Conn
+	closing bool
+}
+
+func (np *netpoll) dispatch(c *Conn) {
+	// the event loop must not wait for the workers
+	np.queue(c)
+}
+
+// queue queues c for a worker reporting whether the workers are still running.
+func (np *netpoll) queue(c *Conn) bool {
+	np.mu.Lock()
+	if np.closing {
+		np.mu.Unlock()
+		return false
+	}
+	np.ready = append(np.ready, c)
+	np.mu.Unlock()
+
+	np.cond.Signal()
+
+	return true
+}
+
+// next returns the next readable connection, nil once the workers are stopped.
+func (np *netpoll) next() *Conn {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	for len(np.ready) == 0 {
+		if np.closing {
+			return nil
+		}
+
+		np.cond.Wait()
+	}
+
+	c := np.ready[0]
+	np.ready[0] = nil
+	np.ready = np.ready[1:]
+
+	return c
+}
+
+func (np *netpoll) work() {
+	for c := np.next(); c != nil; c = np.next() {
+		np.s.pollRead(c)
+	}
+}
+
+// pollConn is the state of a connection served in netpoll mode.
+type pollConn struct {
+	np *netpoll
+	fd int
+	rc syscall.RawConn
+
+	// in holds the data read from off not handled yet, i.e. an incomplete frame.
+	in  *[]byte
+	off int
+
+	// want is the length of the incomplete frame once its header has been received.
+	want int
+
+	// wmu serialises the writes.
+	wmu     sync.Mutex
+	wclosed bool
+
+	// mu guards the ownership of the connection.
+	//
+	// A connection waiting to be readable is owned by the event loop,
+	// otherwise it's owned by the goroutine serving it.
+	mu         sync.Mutex
+	waiting    bool
+	registered bool
+	done       bool
+}
+
+// servePolled serves c in netpoll mode reporting whether c can be polled.
+func (s *Server) servePolled(c *Conn) bool {
+	// the connection must be read directly
+	if c.src.r != io.Reader(c.c) || atomic.LoadInt32(&s.poller.stopped) == 1 {
+		return false
+	}
+
+	nc, fd, rc, err := pollableConn(c.c)
+	if err != nil {
+		return false
+	}
+
+	// the hijacked connection might be closed by the HTTP server
+	c.c.Close()
+	c.c, c.src.r = nc, nc
+
+	c.poll = &pollConn{
+		np: s.poller,
+		fd: fd,
+		rc: rc,
+	}
+
+	// the connection holds no channels while idle
+	c.input, c.output = nil, nil
+
+	c.begin()
+
+	if s.openHandler != nil {
+		s.openHandler(c)
+	}
+
+	if c.src.buffered() {
+		s.serveReadable(c)
+	} else {
+		s.pollIdle(c)
+	}
+
+	return true
+}
+
+// pollRead serves c once it's readable.
+func (s *Server) pollRead(c *Conn) {
+	p := c.poll
+
+	p.mu.Lock()
+	if !p.waiting || p.done {
+		p.mu.Unlock()
+		return
+	}
+	p.waiting = false
+	p.mu.Unlock()
+
+	// the connection was queued to be closed
+	if atomic.LoadInt32(&c.closed) == 1 {
+		s.pollClose(c)
+		return
+	}
+
+	s.serveReadable(c)
+}
+
+// serveReadable handles the frames received until no more data is available.
+func (s *Server) serveReadable(c *Conn) {
+	for {
+		more, err := c.pollFill()
+
+		for c.readErr == nil && atomic.LoadInt32(&c.closed) == 0 {
+			fr := c.pollFrame(err)
+			if fr == nil {
+				break
+			}
+
+			s.frHandler(c, fr)
+		}
+
+		if !more || c.readErr != nil || atomic.LoadInt32(&c.closed) == 1 {
+			break
+		}
+	}
+
+	// the idle connections hold no read buffer
+	c.poll.releaseInput()
+
+	s.pollIdle(c)
+}
+
+// pollFill reads the data available without blocking, up to the
+// read buffer size or the size of the incomplete frame.
+//
+// more reports whether some data might still be available.
+func (c *Conn) pollFill() (more bool, err error) {
+	p := c.poll
+
+	// the data buffered along with the handshake is read first
+	if len(c.src.pending) != 0 {
+		p.grow(len(c.src.pending))
+		*p.in = append(*p.in, c.src.pending...)
+		c.src.pending = nil
+	}
+
+	want := c.readBufferSize
+	if p.want > want {
+		want = p.want
+	}
+
+	for p.in == nil || len(*p.in)-p.off < want {
+		p.grow(want)
+
+		in := *p.in
+
+		n, err := readAvailable(p.rc, in[len(in):cap(in)])
+		*p.in = in[:len(in)+n]
+
+		switch {
+		case err == errWouldBlock:
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// pollFrame returns the next frame held by the input buffer, nil if it's incomplete.
+//
+// err is the error reading the connection, reported once the complete frames have been returned.
+func (c *Conn) pollFrame(err error) *Frame {
+	p := c.poll
+
+	var in []byte
+	if p.in != nil {
+		in = (*p.in)[p.off:]
+	}
+
+	fr := AcquireFrame()
+
+	n, perr := fr.parseHeader(in)
+	if perr == nil && c.MaxPayloadSize > 0 && fr.Len() > c.MaxPayloadSize {
+		perr = ErrFrameTooBig
+	}
+
+	p.want = 0
+	if perr == nil && uint64(len(in)-n) < fr.Len() {
+		// the incomplete frame is read as a whole
+		p.want = n + int(fr.Len())
+		perr = io.ErrShortBuffer
+	}
+
+	switch {
+	case perr == io.ErrShortBuffer:
+		ReleaseFrame(fr)
+
+		if err == nil {
+			return nil
+		}
+
+		// the connection failed in the middle of the frame
+		if len(in) != 0 {
+			err = truncated(err)
+		}
+
+		p.off += len(in)
+		c.readFailed(err)
+		c.readErr = err
+
+		return nil
+	case perr != nil:
+		ReleaseFrame(fr)
+		c.readFailed(perr)
+		c.readErr = perr
+
+		return nil
+	}
+
+	size := int(fr.Len())
+	fr.growPayload(size)
+	fr.b = fr.b[:size]
+	copy(fr.b, in[n:])
+
+	p.off += n + size
+
+	// the invalid frames are reported by frameRead
+	fr, err = c.frameRead(fr)
+	if err != nil {
+		c.readErr = err
+		return nil
+	}
+
+	return fr
+}
+
+// pollNextFrame returns the next frame waiting for it to be received
+// up to ReadTimeout, i.e. the continuation frames of a message being streamed.
+func (c *Conn) pollNextFrame() (*Frame, error) {
+	var err error
+
+	for {
+		if fr := c.pollFrame(err); fr != nil || c.readErr != nil {
+			return fr, c.readErr
+		}
+
+		if c.ReadTimeout > 0 {
+			c.c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		}
+
+		p := c.poll
+		p.grow(c.readBufferSize)
+
+		in := *p.in
+
+		var n int
+		n, err = c.c.Read(in[len(in):cap(in)])
+		*p.in = in[:len(in)+n]
+
+		if c.ReadTimeout > 0 {
+			c.c.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// pollInputPool pools the input buffers of the connections served in netpoll mode.
+var pollInputPool sync.Pool
+
+// maxPooledInput is the max capacity of the input buffers kept by the pool.
+const maxPooledInput = 1 << 18
+
+// grow makes room for n more bytes in the input buffer, dropping the data handled already.
+func (p *pollConn) grow(n int) {
+	if p.in == nil {
+		if b, ok := pollInputPool.Get().(*[]byte); ok {
+			p.in = b
+		} else {
+			b := make([]byte, 0, DefaultReadBufferSize)
+			p.in = &b
+		}
+	}
+
+	in := *p.in
+
+	if p.off > 0 {
+		in = in[:copy(in, in[p.off:])]
+		p.off = 0
+	}
+
+	if cap(in)-len(in) < n {
+		in = append(in[:cap(in)], make([]byte, n-cap(in)+len(in))...)[:len(in)]
+	}
+
+	*p.in = in
+}
+
+// releaseInput releases the input buffer unless it holds an incomplete frame.
+func (p *pollConn) releaseInput() {
+	if p.in == nil || p.off < len(*p.in) {
+		return
+	}
+
+	if cap(*p.in) <= maxPooledInput {
+		*p.in = (*p.in)[:0]
+		pollInputPool.Put(p.in)
+	}
+
+	p.in = nil
+	p.off = 0
+}
+
+// pollIdle waits for c to be readable unless it's closed.
+func (s *Server) pollIdle(c *Conn) {
+	p := c.poll
+
+	p.mu.Lock()
+
+	stopped := false
+
+	if c.readErr == nil && atomic.LoadInt32(&c.closed) == 0 {
+		err := p.np.ep.arm(c, p.fd, !p.registered)
+		if err == nil {
+			p.registered = true
+			p.waiting = true
+			p.mu.Unlock()
+
+			return
+		}
+
+		if stopped = err == errNetpollStopped; !stopped {
+			c.setCause(err)
+			c.recordError(false, err)
+		}
+	}
+
+	p.mu.Unlock()
+
+	if stopped {
+		c.CloseDetail(StatusGoAway, "")
+	}
+
+	s.pollClose(c)
+}
+
+// pollShutdown closes c, handing it to a worker if no goroutine is serving it.
+//
+// The CloseHandler doesn't run in the closing goroutine, which might
+// hold a lock taken by the handler (i.e. broadcasting the messages).
+func (s *Server) pollShutdown(c *Conn) {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.closer)
+	}
+
+	p := c.poll
+
+	p.mu.Lock()
+	if !p.waiting || p.done {
+		// the goroutine serving c closes it
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	if p.np.queue(c) {
+		return
+	}
+
+	// the workers are stopped
+	p.mu.Lock()
+	if !p.waiting || p.done {
+		p.mu.Unlock()
+		return
+	}
+	p.waiting = false
+	p.mu.Unlock()
+
+	s.pollClose(c)
+}
+
+// pollClose closes c firing the CloseHandler.
+func (s *Server) pollClose(c *Conn) {
+	p := c.poll
+
+	p.mu.Lock()
+	if p.done {
+		p.mu.Unlock()
+		return
+	}
+	p.done = true
+
+	if p.registered {
+		p.np.ep.remove(p.fd)
+	}
+	p.mu.Unlock()
+
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.closer)
+	}
+
+	c.c.Close()
+
+	c.finishClose()
+	c.cancel(c.closeCause())
+
+	s.notifyClosed(c)
+}
+
+// pollWrite writes fr in netpoll mode.
+func (c *Conn) pollWrite(fr *Frame) {
+	p := c.poll
+
+	p.wmu.Lock()
+
+	if p.wclosed {
+		p.wmu.Unlock()
+		ReleaseFrame(fr)
+
+		return
+	}
+
+	batch := [1]*Frame{fr}
+	isClose, err := c.writeQueued(batch[:])
+
+	p.wclosed = isClose || err != nil
+
+	p.wmu.Unlock()
+
+	if err != nil {
+		p.np.s.pollShutdown(c)
+	}
+}
@@ -0,0 +1,226 @@
+//go:build linux
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// epoller waits for the registered connections to be readable.
+//
+// The connections are registered as one-shot, thus they
+// must be armed again once the available data has been read.
+type epoller struct {
+	fd int
+	// wake is the pipe waking the event loop up once closed.
+	wake [2]int
+
+	// mu guards the connections and holds the closing
+	// of the descriptors while they are being used.
+	mu     sync.RWMutex
+	conns  map[int]*Conn
+	closed bool
+}
+
+func newEpoller() (*epoller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &epoller{
+		fd:    fd,
+		conns: make(map[int]*Conn),
+	}
+
+	err = syscall.Pipe2(ep.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(ep.wake[0]),
+	}
+
+	err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, ep.wake[0], &ev)
+	if err != nil {
+		ep.closeFds()
+		return nil, err
+	}
+
+	return ep, nil
+}
+
+// arm waits for fd to be readable registering c if add is true.
+func (ep *epoller) arm(c *Conn, fd int, add bool) error {
+	ev := syscall.EpollEvent{
+		Events: epollEvents,
+		Fd:     int32(fd),
+	}
+
+	if !add {
+		ep.mu.RLock()
+		defer ep.mu.RUnlock()
+
+		if ep.closed {
+			return errNetpollStopped
+		}
+
+		return syscall.EpollCtl(ep.fd, syscall.EPOLL_CTL_MOD, fd, &ev)
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.closed {
+		return errNetpollStopped
+	}
+
+	ep.conns[fd] = c
+
+	err := syscall.EpollCtl(ep.fd, syscall.EPOLL_CTL_ADD, fd, &ev)
+	if err != nil {
+		delete(ep.conns, fd)
+	}
+
+	return err
+}
+
+// remove unregisters fd. It must be called before closing the connection.
+func (ep *epoller) remove(fd int) {
+	ep.mu.Lock()
+	if !ep.closed {
+		syscall.EpollCtl(ep.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+	}
+	delete(ep.conns, fd)
+	ep.mu.Unlock()
+}
+
+// close stops the event loop returning the registered connections.
+func (ep *epoller) close() []*Conn {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.closed {
+		return nil
+	}
+	ep.closed = true
+
+	conns := make([]*Conn, 0, len(ep.conns))
+	for _, c := range ep.conns {
+		conns = append(conns, c)
+	}
+
+	syscall.Write(ep.wake[1], []byte{0})
+
+	return conns
+}
+
+func (ep *epoller) closeFds() {
+	syscall.Close(ep.wake[0])
+	syscall.Close(ep.wake[1])
+	syscall.Close(ep.fd)
+}
+
+// wait calls dispatch with the connections becoming readable until closed.
+func (ep *epoller) wait(dispatch func(c *Conn)) {
+	events := make([]syscall.EpollEvent, 128)
+
+	for {
+		n, err := syscall.EpollWait(ep.fd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == ep.wake[0] {
+				// the descriptors are not being used once closed
+				ep.mu.Lock()
+				ep.closeFds()
+				ep.mu.Unlock()
+
+				return
+			}
+
+			ep.mu.RLock()
+			c := ep.conns[fd]
+			ep.mu.RUnlock()
+
+			if c != nil {
+				dispatch(c)
+			}
+		}
+	}
+}
+
+// pollableConn returns a duplicate of the TCP connection c along with
+// its file descriptor, so it remains open once the HTTP server closes c
+// (i.e. fasthttp without KeepHijackedConns).
+func pollableConn(c net.Conn) (net.Conn, int, syscall.RawConn, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, 0, nil, ErrNetpollUnsupported
+	}
+
+	f, err := tc.File()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+
+	nc, err := net.FileConn(f)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	rc, err := nc.(*net.TCPConn).SyscallConn()
+	if err == nil {
+		fd := -1
+		err = rc.Control(func(sfd uintptr) {
+			fd = int(sfd)
+		})
+		if err == nil {
+			return nc, fd, rc, nil
+		}
+	}
+
+	nc.Close()
+
+	return nil, 0, nil, err
+}
+
+// readAvailable reads the data available on rc without blocking,
+// errWouldBlock is returned if none is.
+func readAvailable(rc syscall.RawConn, b []byte) (n int, err error) {
+	rerr := rc.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), b)
+		return true
+	})
+
+	switch {
+	case rerr != nil:
+		return 0, rerr
+	case err == syscall.EAGAIN:
+		return 0, errWouldBlock
+	case err != nil:
+		return 0, os.NewSyscallError("read", err)
+	case n == 0:
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,521 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// serveNetpoll serves ws in netpoll mode over TCP returning the address.
+func serveNetpoll(tb testing.TB, ws *Server) string {
+	tb.Helper()
+
+	if err := ws.EnableNetpoll(4); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(ws.StopNetpoll)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	s := fasthttp.Server{
+		Handler:           ws.Upgrade,
+		KeepHijackedConns: true,
+	}
+	go s.Serve(ln)
+
+	return ln.Addr().String()
+}
+
+func serveNetpollHandshake(t *testing.T, ws *Server) (net.Conn, func()) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", serveNetpoll(t, ws))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+	}
+}
+
+func echoServer(closed chan<- CloseInfo) *Server {
+	ws := &Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- info
+	})
+
+	return ws
+}
+
+func testEcho(t *testing.T, conn *Client, n int) {
+	t.Helper()
+
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf("message %d", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, b, err := conn.ReadMessage(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(b) != msg {
+			t.Errorf("%s <> %s", b, msg)
+			return
+		}
+	}
+}
+
+func TestNetpollEcho(t *testing.T) {
+	const conns = 50
+
+	closed := make(chan CloseInfo, conns)
+	addr := serveNetpoll(t, echoServer(closed))
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := Dial("ws://" + addr + "/")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			testEcho(t, conn, 10)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < conns; i++ {
+		select {
+		case info := <-closed:
+			if !info.Remote || info.Status != StatusNone || info.Err != nil {
+				t.Fatalf("unexpected close: %+v", info)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestNetpollNetUpgrade(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+
+	ws := echoServer(closed)
+	if err := ws.EnableNetpoll(4); err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testEcho(t, conn, 10)
+	conn.Close()
+
+	select {
+	case info := <-closed:
+		if !info.Remote || info.Status != StatusNone {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNetpollPipelinedFrames(t *testing.T) {
+	testPipelinedFrames(t, serveNetpollHandshake)
+}
+
+func TestNetpollInvalidFrame(t *testing.T) {
+	testInvalidFrame(t, serveNetpollHandshake)
+}
+
+func TestNetpollFrameTooBig(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+
+	ws := echoServer(closed)
+	ws.HandleOpen(func(c *Conn) {
+		c.MaxPayloadSize = 8
+	})
+
+	conn, err := Dial("ws://" + serveNetpoll(t, ws) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the frame is rejected once its header is received
+	conn.Write([]byte(strings.Repeat("x", 16)))
+
+	select {
+	case info := <-closed:
+		if !errors.Is(info.Err, ErrFrameTooBig) {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNetpollHandleStream(t *testing.T) {
+	ch := make(chan string, 1)
+
+	ws := &Server{}
+	ws.HandleStream(func(c *Conn, isBinary bool, r io.Reader) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+
+		ch <- string(b)
+	})
+
+	conn, err := Dial("ws://" + serveNetpoll(t, ws) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetPayload([]byte("streamed "))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	// the frames are read as they arrive
+	time.Sleep(time.Millisecond * 10)
+
+	fr.Reset()
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload([]byte("ping"))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	fr.Reset()
+	fr.SetContinuation()
+	fr.SetFin()
+	fr.SetPayload([]byte("message"))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsPong() {
+		t.Fatalf("expected pong, got %s", fr.Code())
+	}
+
+	select {
+	case data := <-ch:
+		if data != "streamed message" {
+			t.Fatalf("unexpected message: %s", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNetpollServerClose(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+	opened := make(chan *Conn, 1)
+
+	ws := echoServer(closed)
+	ws.HandleOpen(func(c *Conn) {
+		opened <- c
+	})
+
+	conn, err := Dial("ws://" + serveNetpoll(t, ws) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// closing an idle connection from another goroutine
+	c := <-opened
+	time.Sleep(time.Millisecond * 10)
+	c.CloseDetail(StatusGoAway, "bye")
+
+	select {
+	case info := <-closed:
+		if info.Remote || info.Status != StatusGoAway || info.Reason != "bye" {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case <-c.Context().Done():
+	default:
+		t.Fatal("context not cancelled")
+	}
+
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	_, _, err = conn.ReadMessage(nil)
+	if e, ok := err.(Error); !ok || e.Status != StatusGoAway {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNetpollStalledFrame(t *testing.T) {
+	closed := make(chan CloseInfo, 2)
+
+	// a single worker
+	ws := echoServer(closed)
+	if err := ws.EnableNetpoll(1); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.StopNetpoll()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the hijacked connections are closed by fasthttp once polled
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	stalled, err := Dial("ws://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte("stalled"))
+	fr.Mask()
+
+	var bf bytes.Buffer
+	fr.WriteTo(&bf)
+
+	// the peer stalls after sending the frame header
+	stalled.c.Write(bf.Next(2))
+
+	conn, err := Dial("ws://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the stalled frame holds no worker
+	testEcho(t, conn, 10)
+
+	stalled.c.Write(bf.Bytes())
+	stalled.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	_, b, err := stalled.ReadMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "stalled" {
+		t.Fatalf("unexpected message: %s", b)
+	}
+}
+
+func TestNetpollBusyWorkers(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		handled = make(chan string, 3)
+	)
+
+	ws := &Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "block" {
+			<-release
+		}
+
+		handled <- string(data)
+	})
+
+	// a single worker
+	if err := ws.EnableNetpoll(1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ws.StopNetpoll)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler:           ws.Upgrade,
+		KeepHijackedConns: true,
+	}
+	go s.Serve(ln)
+
+	busy, err := Dial("ws://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	busy.Write([]byte("block"))
+	time.Sleep(time.Millisecond * 50)
+
+	for i := 0; i < 2; i++ {
+		conn, err := Dial("ws://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("queued"))
+	}
+
+	// the readable connections wait for the worker
+	select {
+	case data := <-handled:
+		t.Fatalf("unexpected message: %s", data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+
+	for _, expected := range []string{"block", "queued", "queued"} {
+		select {
+		case data := <-handled:
+			if data != expected {
+				t.Fatalf("%s <> %s", data, expected)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestNetpollCloseLocked(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		opened = make(chan *Conn, 1)
+		closed = make(chan struct{})
+	)
+
+	ws := &Server{}
+	ws.HandleOpen(func(c *Conn) {
+		opened <- c
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		// i.e. removing the connection from the broadcast list
+		mu.Lock()
+		mu.Unlock()
+
+		close(closed)
+	})
+
+	conn, err := Dial("ws://" + serveNetpoll(t, ws) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := <-opened
+
+	// the idle connection is closed holding the lock taken by the CloseHandler
+	done := make(chan struct{})
+	go func() {
+		mu.Lock()
+		c.Close()
+		mu.Unlock()
+
+		close(done)
+	}()
+
+	for _, ch := range []chan struct{}{done, closed} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatal("deadlock")
+		}
+	}
+}
+
+func TestStopNetpoll(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+
+	ws := echoServer(closed)
+	addr := serveNetpoll(t, ws)
+
+	conn, err := Dial("ws://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testEcho(t, conn, 1)
+
+	// the polled connections are closed
+	ws.StopNetpoll()
+
+	_, _, err = conn.ReadMessage(nil)
+	if e, ok := err.(Error); !ok || e.Status != StatusGoAway {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case info := <-closed:
+		if info.Remote || info.Status != StatusGoAway {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the connections upgraded afterwards are served as usual
+	conn, err = Dial("ws://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testEcho(t, conn, 10)
+}
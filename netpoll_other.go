@@ -0,0 +1,35 @@
+//go:build !linux
+
+package websocket
+
+import (
+	"net"
+	"syscall"
+)
+
+// epoller is only implemented on Linux.
+type epoller struct{}
+
+func newEpoller() (*epoller, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (ep *epoller) arm(c *Conn, fd int, add bool) error {
+	return ErrNetpollUnsupported
+}
+
+func (ep *epoller) remove(fd int) {}
+
+func (ep *epoller) close() []*Conn {
+	return nil
+}
+
+func (ep *epoller) wait(dispatch func(c *Conn)) {}
+
+func pollableConn(c net.Conn) (net.Conn, int, syscall.RawConn, error) {
+	return nil, 0, nil, ErrNetpollUnsupported
+}
+
+func readAvailable(rc syscall.RawConn, b []byte) (int, error) {
+	return 0, ErrNetpollUnsupported
+}
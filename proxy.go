@@ -0,0 +1,294 @@
+package websocket
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+type (
+	// ProxyBackend returns the URL of the backend the upgrade request h is forwarded to.
+	//
+	// The URL must follow the WebSocket URL format i.e. ws://host:port/path
+	ProxyBackend func(h *fasthttp.RequestHeader) (url string, err error)
+	// ProxyFrameHandler receives the data frames being forwarded by the Proxy.
+	//
+	// The handler can inspect or rewrite the frame. If the handler returns false
+	// the frame is dropped. Dropping some of the frames of a fragmented message
+	// leaves the message incomplete.
+	ProxyFrameHandler func(c *Conn, fr *Frame) bool
+)
+
+// Proxy forwards the WebSocket connections to backends.
+//
+// The backend is dialed before the connection is upgraded, the upgrade is
+// rejected with 502 Bad Gateway if the backend cannot be reached.
+// The subprotocol selected by the backend is returned to the client.
+//
+// The frames are forwarded as they are received, preserving
+// the opcodes, the fragmentation and the close codes.
+type Proxy struct {
+	// Backend selects the backend of each connection.
+	Backend ProxyBackend
+
+	// Headers are the request headers forwarded to the backend i.e. Cookie or Authorization.
+	//
+	// The subprotocols requested by the client are always forwarded.
+	Headers []string
+
+	// UpgradeHandler allows the user to handle RequestCtx when upgrading for fasthttp.
+	//
+	// If UpgradeHandler returns false the connection won't be upgraded.
+	UpgradeHandler UpgradeHandler
+
+	// UpgradeNetHandler allows the user to handle the request when upgrading for net/http.
+	//
+	// If UpgradeNetHandler returns false, the connection won't be upgraded.
+	UpgradeNetHandler UpgradeNetHandler
+
+	// Origin is used to limit the clients coming from the defined origin
+	Origin string
+
+	// ClientFrame receives the data frames sent by the client before forwarding them to the backend.
+	ClientFrame ProxyFrameHandler
+
+	// BackendFrame receives the data frames sent by the backend before forwarding them to the client.
+	BackendFrame ProxyFrameHandler
+
+	nextID uint64
+}
+
+// upgrader returns the Upgrader dialing the backend when the request is accepted.
+//
+// bc is set to the backend connection once dialed.
+func (p *Proxy) upgrader(bc **Client) *Upgrader {
+	u := &Upgrader{
+		Origin: p.Origin,
+		selectProto: func(_ [][]byte) string {
+			return (*bc).Subprotocol()
+		},
+	}
+
+	u.UpgradeHandler = func(ctx *fasthttp.RequestCtx) bool {
+		if p.UpgradeHandler != nil && !p.UpgradeHandler(ctx) {
+			return false
+		}
+
+		c, err := p.dial(&ctx.Request.Header)
+		if err != nil {
+			ctx.Error(fasthttp.StatusMessage(fasthttp.StatusBadGateway), fasthttp.StatusBadGateway)
+			return false
+		}
+
+		*bc = c
+
+		return true
+	}
+
+	u.UpgradeNetHandler = func(resp http.ResponseWriter, req *http.Request) bool {
+		if p.UpgradeNetHandler != nil && !p.UpgradeNetHandler(resp, req) {
+			return false
+		}
+
+		c, err := p.dial(netRequestHeader(req))
+		if err != nil {
+			http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return false
+		}
+
+		*bc = c
+
+		return true
+	}
+
+	return u
+}
+
+// dial dials the backend forwarding the headers of h.
+func (p *Proxy) dial(h *fasthttp.RequestHeader) (*Client, error) {
+	url, err := p.Backend(h)
+	if err != nil {
+		return nil, err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	h.VisitAll(func(k, v []byte) {
+		if equalsFold(k, wsHeaderProtocol) {
+			req.Header.AddBytesKV(k, v)
+			return
+		}
+
+		for _, name := range p.Headers {
+			if equalsFold(k, s2b(name)) {
+				req.Header.AddBytesKV(k, v)
+				break
+			}
+		}
+	})
+
+	return DialWithHeaders(url, req)
+}
+
+// Upgrade upgrades the websocket connection forwarding it to the backend.
+func (p *Proxy) Upgrade(ctx *fasthttp.RequestCtx) {
+	var bc *Client
+
+	pb := &pendingBackend{}
+
+	err := p.upgrader(&bc).upgrade(ctx, func(c *Conn) {
+		pb.hijacked = true
+		p.serve(c, bc)
+	})
+	if err != nil {
+		if bc != nil {
+			bc.Shutdown()
+		}
+		return
+	}
+
+	// the RequestCtx closes its user values once released
+	pb.bc = bc
+	ctx.SetUserValue(pendingBackendKey, pb)
+}
+
+const pendingBackendKey = "websocket.proxy.backend"
+
+// pendingBackend shuts the backend down once the RequestCtx is released
+// unless the connection has been hijacked, i.e. the response could not be written.
+type pendingBackend struct {
+	bc       *Client
+	hijacked bool
+}
+
+func (pb *pendingBackend) Close() error {
+	if pb.hijacked {
+		return nil
+	}
+
+	return pb.bc.Shutdown()
+}
+
+// NetUpgrade upgrades the websocket connection for net/http forwarding it to the backend.
+//
+// HTTP/2 extended CONNECT requests (RFC 8441) are upgraded too.
+func (p *Proxy) NetUpgrade(resp http.ResponseWriter, req *http.Request) {
+	var bc *Client
+
+	c, err := p.upgrader(&bc).upgradeHTTP(resp, req)
+	if err != nil {
+		if bc != nil {
+			bc.Shutdown()
+		}
+		return
+	}
+
+	// the stream ends when the handler returns
+	if isExtendedConnect(req) {
+		p.serve(c, bc)
+	} else {
+		go p.serve(c, bc)
+	}
+}
+
+// serve forwards the frames between c and the backend connection bc until one of them is closed.
+func (p *Proxy) serve(c *Conn, bc *Client) {
+	c.id = atomic.AddUint64(&p.nextID, 1)
+	c.start()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		p.forwardBackend(c, bc)
+	}()
+
+	p.forwardClient(c, bc)
+
+	// stop reading from the backend,
+	// a no-op once the close frame has been forwarded
+	bc.CloseDetail(StatusGoAway, "")
+	<-done
+
+	// stop the write loop which closes the connection
+	c.CloseDetail(StatusGoAway, "")
+	c.wg.Wait()
+}
+
+// forwardClient forwards the frames received from the client to the backend.
+func (p *Proxy) forwardClient(c *Conn, bc *Client) {
+	for {
+		select {
+		case fr := <-c.input:
+			if fr.IsMasked() {
+				fr.Unmask()
+			}
+
+			if fr.IsClose() {
+				status, reason := fr.Status(), string(fr.Payload())
+				ReleaseFrame(fr)
+
+				// reply back on behalf of the backend before closing it,
+				// so the GoAway of forwardBackend is a no-op
+				c.CloseDetail(status, "")
+				bc.CloseDetail(status, reason)
+
+				return
+			}
+
+			if !fr.IsControl() && p.ClientFrame != nil && !p.ClientFrame(c, fr) {
+				ReleaseFrame(fr)
+				continue
+			}
+
+			fr.Mask()
+
+			_, err := bc.WriteFrame(fr)
+			ReleaseFrame(fr)
+
+			if err != nil {
+				return
+			}
+		case <-c.errch:
+			return
+		case <-c.closer:
+			return
+		}
+	}
+}
+
+// forwardBackend forwards the frames received from the backend to the client.
+func (p *Proxy) forwardBackend(c *Conn, bc *Client) {
+	for {
+		fr := AcquireFrame()
+
+		_, err := bc.ReadFrame(fr)
+		if err != nil {
+			ReleaseFrame(fr)
+			c.CloseDetail(StatusGoAway, "")
+
+			return
+		}
+
+		if fr.IsClose() {
+			status, reason := fr.Status(), string(fr.Payload())
+			ReleaseFrame(fr)
+
+			// reply back on behalf of the client before closing it,
+			// so the GoAway of serve is a no-op
+			bc.CloseDetail(status, "")
+			c.CloseDetail(status, reason)
+
+			return
+		}
+
+		if !fr.IsControl() && p.BackendFrame != nil && !p.BackendFrame(c, fr) {
+			ReleaseFrame(fr)
+			continue
+		}
+
+		c.WriteFrame(fr)
+	}
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// serveProxyBackend runs a backend echoing the data frames as they are received.
+//
+// The backend closes the connection when receiving "quit"
+// and reports the close frames received on closed, including the replies.
+func serveProxyBackend(t *testing.T, closed chan<- Error) string {
+	ws := Server{
+		Protocols: []string{"chat"},
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			if v := req.Header.Get("X-Custom"); v != "custom" {
+				t.Errorf("unexpected header value: %s", v)
+			}
+			if v := req.Header.Get("X-Private"); v != "" {
+				t.Errorf("unexpected header forwarded: %s", v)
+			}
+
+			return true
+		},
+	}
+
+	ws.HandleFrame(func(c *Conn, fr *Frame) {
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		switch {
+		case fr.IsClose():
+			closed <- Error{Status: fr.Status(), Reason: string(fr.Payload())}
+			c.CloseDetail(fr.Status(), "")
+			ReleaseFrame(fr)
+		case fr.IsPing():
+			fr.SetPong()
+			c.WriteFrame(fr)
+		case string(fr.Payload()) == "quit":
+			// written bypassing the write loop, which would close
+			// the connection, so the reply is received
+			fr.Reset()
+			fr.SetClose()
+			fr.SetFin()
+			fr.SetStatus(StatusCode(4001))
+			io.WriteString(fr, "bye")
+			fr.WriteTo(c.c)
+			ReleaseFrame(fr)
+		default:
+			c.WriteFrame(fr)
+		}
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	t.Cleanup(s.Close)
+
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func newTestProxy(backend string) *Proxy {
+	return &Proxy{
+		Backend: func(h *fasthttp.RequestHeader) (string, error) {
+			uri := fasthttp.AcquireURI()
+			defer fasthttp.ReleaseURI(uri)
+
+			uri.UpdateBytes(h.RequestURI())
+
+			return backend + string(uri.Path()), nil
+		},
+		Headers: []string{"X-Custom"},
+		ClientFrame: func(c *Conn, fr *Frame) bool {
+			return string(fr.Payload()) != "drop"
+		},
+		BackendFrame: func(c *Conn, fr *Frame) bool {
+			fr.SetPayload(bytes.ToUpper(fr.Payload()))
+			return true
+		},
+	}
+}
+
+func proxyRequest() *fasthttp.Request {
+	req := fasthttp.AcquireRequest()
+	req.Header.Set("X-Custom", "custom")
+	req.Header.Set("X-Private", "private")
+	req.Header.SetBytesK(wsHeaderProtocol, "other,chat")
+
+	return req
+}
+
+func readProxied(t *testing.T, conn *Client, code Code, fin bool, payload string) {
+	t.Helper()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.Code() != code || fr.IsFin() != fin || string(fr.Payload()) != payload {
+		t.Fatalf("unexpected frame %s fin=%v: %q", fr.Code(), fr.IsFin(), fr.Payload())
+	}
+}
+
+func testProxy(t *testing.T, dial func(req *fasthttp.Request) (*Client, error), closed <-chan Error) {
+	req := proxyRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	conn, err := dial(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := conn.Subprotocol(); p != "chat" {
+		t.Fatalf("unexpected subprotocol: %s", p)
+	}
+
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	// fragmentation is preserved
+	writeFragmented(t, conn, CodeText, "Hel", "lo")
+	readProxied(t, conn, CodeText, false, "HEL")
+	readProxied(t, conn, CodeContinuation, true, "LO")
+
+	// control frames are forwarded too
+	fr := AcquireFrame()
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload([]byte("ping"))
+	fr.Mask()
+	conn.WriteFrame(fr)
+	ReleaseFrame(fr)
+	readProxied(t, conn, CodePong, true, "ping")
+
+	writeFragmented(t, conn, CodeBinary, "drop")
+	writeFragmented(t, conn, CodeBinary, "next")
+	readProxied(t, conn, CodeBinary, true, "NEXT")
+
+	// the close code is forwarded to the backend
+	fr = AcquireFrame()
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusCode(4000))
+	io.WriteString(fr, "done")
+	fr.Mask()
+	conn.WriteFrame(fr)
+	ReleaseFrame(fr)
+
+	// and echoed back to the client
+	readClose(t, conn, 4000, "")
+	conn.Close()
+
+	select {
+	case e := <-closed:
+		if e.Status != 4000 || e.Reason != "done" {
+			t.Fatalf("unexpected close: %v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the backend close code is forwarded to the client
+	conn, err = dial(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	writeFragmented(t, conn, CodeText, "quit")
+	readClose(t, conn, 4001, "bye")
+
+	// the reply of the client is echoed back to the backend
+	select {
+	case e := <-closed:
+		if e.Status != 4001 {
+			t.Fatalf("unexpected close reply: %v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+// readClose reads a close frame from conn expecting status and reason.
+func readClose(t *testing.T, conn *Client, status StatusCode, reason string) {
+	t.Helper()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsClose() || fr.Status() != status || string(fr.Payload()) != reason {
+		t.Fatalf("unexpected frame %s: %d %q", fr.Code(), fr.Status(), fr.Payload())
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	closed := make(chan Error, 1)
+	p := newTestProxy(serveProxyBackend(t, closed))
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: p.Upgrade,
+	}
+	go s.Serve(ln)
+
+	testProxy(t, func(req *fasthttp.Request) (*Client, error) {
+		c, err := ln.Dial()
+		if err != nil {
+			return nil, err
+		}
+
+		return ClientWithHeaders(c, "http://localhost/chat", req)
+	}, closed)
+}
+
+func TestProxyNetUpgrade(t *testing.T) {
+	closed := make(chan Error, 1)
+	p := newTestProxy(serveProxyBackend(t, closed))
+
+	s := httptest.NewServer(http.HandlerFunc(p.NetUpgrade))
+	defer s.Close()
+
+	testProxy(t, func(req *fasthttp.Request) (*Client, error) {
+		return DialWithHeaders("ws"+strings.TrimPrefix(s.URL, "http")+"/chat", req)
+	}, closed)
+}
+
+func TestProxyBackendUnavailable(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	p := newTestProxy("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	s := httptest.NewServer(http.HandlerFunc(p.NetUpgrade))
+	defer s.Close()
+
+	_, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if !errors.Is(err, ErrCannotUpgrade) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProxyBackendNotHijacked(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+
+	ws := Server{}
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- info
+	})
+
+	backend := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer backend.Close()
+
+	p := newTestProxy("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			p.Upgrade(ctx)
+
+			// the connection is never hijacked
+			ctx.Hijack(nil)
+		},
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	doHandshake(t, c, "/")
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("backend not closed")
+	}
+}
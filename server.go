@@ -1,13 +1,10 @@
 package websocket
 
 import (
-	"bytes"
-	"context"
 	"errors"
 	"io"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -25,13 +22,19 @@ type (
 	// MessageHandler receives the payload content of a data frame
 	// indicating whether the content is binary or not.
 	MessageHandler func(c *Conn, isBinary bool, data []byte)
+	// StreamHandler receives the content of a data message as a reader
+	// spanning all the frames of the message.
+	//
+	// The reader is only valid until StreamHandler returns.
+	StreamHandler func(c *Conn, isBinary bool, r io.Reader)
 	// FrameHandler receives the raw frame. This handler is optional,
 	// if none is specified the server will run a default handler.
 	//
 	// If the user specifies a FrameHandler, then it is going to receive all incoming frames.
 	FrameHandler func(c *Conn, fr *Frame)
-	// CloseHandler fires when a connection has been closed.
-	CloseHandler func(c *Conn, err error)
+	// CloseHandler fires once a connection has been closed
+	// receiving the details of the closure.
+	CloseHandler func(c *Conn, info CloseInfo)
 	// ErrorHandler fires when an unknown error happens.
 	ErrorHandler func(c *Conn, err error)
 )
@@ -56,20 +59,74 @@ type Server struct {
 	// Origin is used to limit the clients coming from the defined origin
 	Origin string
 
+	// ReadBufferSize is the size of the buffer used to read the frames.
+	//
+	// The buffers are taken from a pool while the frames are being read,
+	// thus the idle connections hold no read buffer.
+	// By default ReadBufferSize is DefaultReadBufferSize.
+	ReadBufferSize int
+
+	// WriteBufferSize is the max payload size of the frames copied into
+	// the write buffer, the larger payloads are written without being copied.
+	//
+	// By default WriteBufferSize is DefaultWriteBufferSize.
+	WriteBufferSize int
+
+	// WriteBatchSize is the max number of queued frames written at once.
+	//
+	// By default WriteBatchSize is DefaultWriteBatchSize.
+	WriteBatchSize int
+
+	// ReuseConns recycles the channels of the Conns once the connections
+	// are closed and the CloseHandler has returned.
+	//
+	// The frames written using a Conn released that way are discarded,
+	// the references taken using Conn.Ref report it with ErrStaleConn.
+	// The connections served in netpoll mode are not recycled.
+	//
+	// The Conn itself is not reused, as a stale *Conn must not reach the
+	// next connection. The reassembly buffers are always returned to
+	// their pool and the read buffers are only held while reading.
+	ReuseConns bool
+
+	// Metrics collects the metrics of the upgrades and the connections if defined.
+	Metrics Metrics
+
+	// Tracer traces the handshakes, the messages handled and the closures if defined.
+	//
+	// The trace context is extracted from the handshake request headers and
+	// the Conn context holds the span of the handshake, thus the spans started
+	// from Conn.Context belong to the trace of the connection.
+	Tracer Tracer
+
 	nextID uint64
 
 	openHandler  OpenHandler
 	frHandler    FrameHandler
 	closeHandler CloseHandler
 	msgHandler   MessageHandler
+	strHandler   StreamHandler
 	pingHandler  PingHandler
 	pongHandler  PongHandler
 	errHandler   ErrorHandler
 
+	poller *netpoll
+
+	// upgrader upgrades the requests using the Server options.
+	upgrader *Upgrader
+
 	once sync.Once
 }
 
 func (s *Server) initServer() {
+	s.upgrader = &Upgrader{
+		UpgradeHandler:    s.UpgradeHandler,
+		UpgradeNetHandler: s.UpgradeNetHandler,
+		Protocols:         s.Protocols,
+		Origin:            s.Origin,
+		Tracer:            s.Tracer,
+	}
+
 	if s.frHandler != nil {
 		return
 	}
@@ -82,6 +139,14 @@ func (s *Server) HandleData(msgHandler MessageHandler) {
 	s.msgHandler = msgHandler
 }
 
+// HandleStream sets the StreamHandler.
+//
+// When defined, the messages are not buffered and the MessageHandler is not called.
+// Each frame is still limited by Conn.MaxPayloadSize.
+func (s *Server) HandleStream(streamHandler StreamHandler) {
+	s.strHandler = streamHandler
+}
+
 // HandleOpen sets a callback for handling opening connections.
 func (s *Server) HandleOpen(openHandler OpenHandler) {
 	s.openHandler = openHandler
@@ -119,262 +184,87 @@ func (s *Server) HandleFrame(frameHandler FrameHandler) {
 
 // Upgrade upgrades websocket connections.
 func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
-	if !ctx.IsGet() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return
-	}
-
 	s.once.Do(s.initServer)
 
-	// Checking Origin header if needed
-	origin := ctx.Request.Header.Peek("Origin")
-	if s.Origin != "" {
-		uri := fasthttp.AcquireURI()
-		uri.Update(s.Origin)
-
-		b := bytePool.Get().([]byte)
-		b = prepareOrigin(b, uri)
-		fasthttp.ReleaseURI(uri)
-
-		if !equalsFold(b, origin) {
-			ctx.SetStatusCode(fasthttp.StatusForbidden)
-			//nolint:staticcheck
-			bytePool.Put(b)
-			return
-		}
-		//nolint:staticcheck
-		bytePool.Put(b)
-	}
-
-	// Normalizing must be disabled because of WebSocket header fields.
-	// (This is not a fasthttp bug).
-	ctx.Response.Header.DisableNormalizing()
-
-	// Connection.Value == Upgrade
-	if !ctx.Request.Header.ConnectionUpgrade() {
-		return
-	}
-
-	// Peek sade header field.
-	hup := ctx.Request.Header.PeekBytes(upgradeString)
-	// Compare with websocket string defined by the RFC
-	if !equalsFold(hup, websocketString) {
-		return
-	}
-	// Checking websocket version
-	hversion := ctx.Request.Header.PeekBytes(wsHeaderVersion)
-
-	// Peeking websocket key.
-	hkey := ctx.Request.Header.PeekBytes(wsHeaderKey)
-	hprotos := bytes.Split( // TODO: Reduce allocations. Do not split. Use IndexByte
-		ctx.Request.Header.PeekBytes(wsHeaderProtocol), commaString,
-	)
-
-	supported := false
-	// Checking versions
-	for i := range supportedVersions {
-		if bytes.Contains(supportedVersions[i], hversion) {
-			supported = true
-			break
-		}
-	}
-
-	if !supported {
-		ctx.Error("Versions not supported", fasthttp.StatusBadRequest)
-		return
-	}
-
-	if s.UpgradeHandler != nil {
-		if !s.UpgradeHandler(ctx) {
-			return
-		}
-	}
-	// TODO: compression
-	// compress := mustCompress(exts)
-
-	// Setting response headers
-	ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
-	ctx.Response.Header.AddBytesKV(connectionString, upgradeString)
-	ctx.Response.Header.AddBytesKV(upgradeString, websocketString)
-	ctx.Response.Header.AddBytesKV(wsHeaderAccept, makeKey(hkey, hkey))
-
-	// TODO: implement bad websocket version
-	// https://tools.ietf.org/html/rfc6455#section-4.4
-	if proto := selectProtocol(hprotos, s.Protocols); proto != "" {
-		ctx.Response.Header.AddBytesK(wsHeaderProtocol, proto)
-	}
-
-	nctx := context.Background()
-	ctx.VisitUserValues(func(k []byte, v interface{}) {
-		//nolint:staticcheck
-		nctx = context.WithValue(nctx, string(k), v)
-	})
-
-	ctx.Hijack(func(c net.Conn) {
-		if nc, ok := c.(interface {
-			UnsafeConn() net.Conn
-		}); ok {
-			c = nc.UnsafeConn()
-		}
-
-		conn := acquireConn(c)
-		conn.id = atomic.AddUint64(&s.nextID, 1)
-		// establishing default options
-		conn.ctx = nctx
-
-		if s.openHandler != nil {
-			s.openHandler(conn)
-		}
-
-		s.serveConn(conn)
-	})
+	err := s.upgrader.upgrade(ctx, s.serve)
+	s.reportUpgrade(err)
 }
 
 // NetUpgrade upgrades the websocket connection for net/http.
+//
+// HTTP/2 extended CONNECT requests (RFC 8441) are upgraded too.
 func (s *Server) NetUpgrade(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		resp.WriteHeader(http.StatusBadRequest)
+	s.once.Do(s.initServer)
+
+	c, err := s.upgrader.upgradeHTTP(resp, req)
+	s.reportUpgrade(err)
+	if err != nil {
 		return
 	}
 
-	rs := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(rs)
-
-	s.once.Do(s.initServer)
-
-	// Checking Origin header if needed
-	origin := req.Header.Get("Origin")
-	if s.Origin != "" {
-		uri := fasthttp.AcquireURI()
-		uri.Update(s.Origin)
-
-		b := bytePool.Get().([]byte)
-		b = prepareOrigin(b, uri)
-		fasthttp.ReleaseURI(uri)
-
-		if !equalsFold(b, s2b(origin)) {
-			resp.WriteHeader(http.StatusForbidden)
-			//nolint:staticcheck
-			bytePool.Put(b)
-			return
-		}
-		//nolint:staticcheck
-		bytePool.Put(b)
+	// the stream ends when the handler returns
+	if isExtendedConnect(req) {
+		s.serve(c)
+	} else {
+		go s.serve(c)
 	}
+}
 
-	// Normalizing must be disabled because of WebSocket header fields.
-	// (This is not a fasthttp bug).
-	rs.Header.DisableNormalizing()
+// reportUpgrade reports the result of an upgrade to the metrics.
+func (s *Server) reportUpgrade(err error) {
+	switch {
+	case s.Metrics == nil:
+	case err != nil:
+		s.Metrics.UpgradeRejected(err)
+	default:
+		s.Metrics.UpgradeAccepted()
+	}
+}
 
-	hasUpgrade := false
-	for _, v := range req.Header["Connection"] {
-		if strings.Contains(v, "Upgrade") {
-			hasUpgrade = true
+// serve serves an upgraded connection.
+func (s *Server) serve(c *Conn) {
+	c.id = atomic.AddUint64(&s.nextID, 1)
+	c.metrics = s.Metrics
 
-			break
-		}
+	if s.Metrics != nil {
+		s.Metrics.ConnOpened()
 	}
 
-	// Connection.Value == Upgrade
-	if !hasUpgrade {
-		return
+	if s.ReadBufferSize > 0 {
+		c.readBufferSize = s.ReadBufferSize
 	}
-	// Peek sade header field.
-	hup := req.Header.Get("Upgrade")
-	// Compare with websocket string defined by the RFC
-	if !equalsFold(s2b(hup), websocketString) {
-		return
+	if s.WriteBufferSize > 0 {
+		c.writeBufferSize = s.WriteBufferSize
 	}
-	// Checking websocket version
-	hversion := req.Header.Get(b2s(wsHeaderVersion))
-	// Peeking websocket key.
-	hkey := req.Header.Get(b2s(wsHeaderKey))
-	hprotos := bytes.Split( // TODO: Reduce allocations. Do not split. Use IndexByte
-		s2b(req.Header.Get(b2s(wsHeaderProtocol))), commaString,
-	)
-	supported := false
-	// Checking versions
-	for i := range supportedVersions {
-		if bytes.Contains(supportedVersions[i], s2b(hversion)) {
-			supported = true
-			break
-		}
-	}
-	if !supported {
-		resp.WriteHeader(http.StatusBadRequest)
-		io.WriteString(resp, "Versions not supported")
-		return
+	if s.WriteBatchSize > 0 {
+		c.writeBatchSize = s.WriteBatchSize
 	}
 
-	if s.UpgradeNetHandler != nil {
-		if !s.UpgradeNetHandler(resp, req) {
-			return
-		}
-	}
-	// TODO: compression
-
-	h, ok := resp.(http.Hijacker)
-	if !ok {
-		resp.WriteHeader(http.StatusInternalServerError)
+	if s.poller != nil && s.servePolled(c) {
 		return
 	}
 
-	c, _, err := h.Hijack()
-	if err != nil {
-		io.WriteString(resp, err.Error())
-		return
-	}
-
-	// Setting response headers
-	rs.SetStatusCode(fasthttp.StatusSwitchingProtocols)
-	rs.Header.AddBytesKV(connectionString, upgradeString)
-	rs.Header.AddBytesKV(upgradeString, websocketString)
-	rs.Header.AddBytesKV(wsHeaderAccept, makeKey(s2b(hkey), s2b(hkey)))
-	// TODO: implement bad websocket version
-	// https://tools.ietf.org/html/rfc6455#section-4.4
-	if proto := selectProtocol(hprotos, s.Protocols); proto != "" {
-		rs.Header.AddBytesK(wsHeaderProtocol, proto)
-	}
+	c.start()
 
-	_, err = rs.WriteTo(c)
-	if err != nil {
-		c.Close()
-		return
+	if s.openHandler != nil {
+		s.openHandler(c)
 	}
 
-	go func(ctx context.Context) {
-		conn := acquireConn(c)
-		conn.id = atomic.AddUint64(&s.nextID, 1)
-		conn.ctx = ctx
+	s.serveConn(c)
 
-		if s.openHandler != nil {
-			s.openHandler(conn)
-		}
-
-		s.serveConn(conn)
-	}(req.Context())
+	if s.ReuseConns {
+		releaseConn(c)
+	}
 }
 
 func (s *Server) serveConn(c *Conn) {
-	var closeErr error
-
 loop:
 	for {
 		select {
 		case fr := <-c.input:
 			s.frHandler(c, fr)
 		case err := <-c.errch:
-			if err == nil {
-				break loop
-			}
-			ce := closeError{}
-			if errors.As(err, &ce) {
-				closeErr = ce.err
-				break loop
-			}
-			e := Error{}
-			if errors.As(err, &e) {
-				closeErr = e
+			if err == nil || errors.As(err, &closeError{}) || errors.As(err, &Error{}) {
 				break loop
 			}
 
@@ -386,13 +276,40 @@ loop:
 		}
 	}
 
-	if s.closeHandler != nil {
-		s.closeHandler(c, closeErr)
+	// stop the write loop which closes the connection
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.closer)
 	}
 
-	c.c.Close()
-
 	c.wg.Wait()
+
+	s.notifyClosed(c)
+}
+
+// notifyClosed fires the CloseHandler once c has been closed.
+func (s *Server) notifyClosed(c *Conn) {
+	info := c.CloseInfo()
+
+	if s.Metrics != nil {
+		s.Metrics.ConnClosed(info)
+	}
+
+	var span Span
+	if s.Tracer != nil {
+		span = s.startSpan(c, SpanClose)
+		span.SetAttribute(AttrCloseStatus, int(info.Status))
+		span.SetAttribute(AttrCloseReason, info.Reason)
+		span.SetAttribute(AttrCloseRemote, info.Remote)
+		span.SetAttribute(AttrCloseDuration, info.Duration)
+	}
+
+	if s.closeHandler != nil {
+		s.closeHandler(c, info)
+	}
+
+	if span != nil {
+		endSpan(span, info.Err)
+	}
 }
 
 func (s *Server) handleFrame(c *Conn, fr *Frame) {
@@ -409,6 +326,11 @@ func (s *Server) handleFrame(c *Conn, fr *Frame) {
 }
 
 func (s *Server) handleFrameData(c *Conn, fr *Frame) {
+	if s.strHandler != nil {
+		s.handleStream(c, fr)
+		return
+	}
+
 	var data []byte
 
 	isBinary := fr.Code() == CodeBinary
@@ -434,12 +356,108 @@ func (s *Server) handleFrameData(c *Conn, fr *Frame) {
 	}
 
 	if len(data) != 0 && s.msgHandler != nil {
+		var span Span
+		if s.Tracer != nil {
+			span = s.startSpan(c, SpanMessage)
+			span.SetAttribute(AttrMessageType, messageType(isBinary))
+			span.SetAttribute(AttrMessageSize, len(data))
+		}
+
 		s.msgHandler(c, isBinary, data)
+
+		if span != nil {
+			span.End()
+		}
 	}
 
 	ReleaseFrame(fr)
 }
 
+func (s *Server) handleStream(c *Conn, fr *Frame) {
+	mr := &messageReader{
+		fr: fr,
+		next: func() (*Frame, error) {
+			return s.nextContinuation(c)
+		},
+	}
+
+	var span Span
+	if s.Tracer != nil {
+		span = s.startSpan(c, SpanMessage)
+		span.SetAttribute(AttrMessageType, messageType(fr.Code() == CodeBinary))
+	}
+
+	s.strHandler(c, fr.Code() == CodeBinary, mr)
+
+	// discard the unread frames of the message
+	io.Copy(io.Discard, mr)
+
+	if span != nil {
+		span.End()
+	}
+}
+
+// startSpan starts a span of c, s.Tracer must not be nil.
+func (s *Server) startSpan(c *Conn, name string) Span {
+	_, span := s.Tracer.Start(c.ctx, name)
+	span.SetAttribute(AttrConnID, c.id)
+
+	return span
+}
+
+// nextContinuation reads the next frame of the message being streamed
+// handling the control frames received in between.
+func (s *Server) nextContinuation(c *Conn) (*Frame, error) {
+	for {
+		var fr *Frame
+
+		if c.poll != nil {
+			var err error
+			if fr, err = c.pollNextFrame(); err != nil {
+				return nil, err
+			}
+		} else {
+			select {
+			case fr = <-c.input:
+			case err := <-c.errch:
+				// let serveConn know about the error too
+				select {
+				case c.errch <- err:
+				default:
+				}
+
+				return nil, unwrapCloseError(err)
+			case <-c.closer:
+				return nil, net.ErrClosed
+			}
+		}
+
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		if fr.IsControl() {
+			isClose := fr.IsClose()
+
+			s.handleControl(c, fr)
+			if isClose {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			continue
+		}
+
+		if !fr.IsContinuation() {
+			ReleaseFrame(fr)
+			c.CloseDetail(StatusProtocolError, errExpectedContinuation.Error())
+
+			return nil, errExpectedContinuation
+		}
+
+		return fr, nil
+	}
+}
+
 func (s *Server) handleControl(c *Conn, fr *Frame) {
 	switch {
 	case fr.IsPing():
@@ -471,18 +489,18 @@ func (s *Server) handlePong(c *Conn, data []byte) {
 }
 
 func (s *Server) handleClose(c *Conn, fr *Frame) {
-	c.errch <- func() error {
-		if fr.Status() != StatusNone {
-			return Error{
-				Status: fr.Status(),
-				Reason: string(fr.Payload()),
-			}
-		}
+	status := fr.Status()
 
-		return nil
-	}()
+	// the reason follows the status, if any
+	var err error
+	cause := Error{Status: status}
+	if status != StatusNone {
+		cause.Reason = string(fr.Payload())
+		err = cause
+	}
 
-	status := fr.Status()
+	c.setCause(cause)
+	c.errch <- err
 
 	fr = AcquireFrame()
 	fr.SetClose()
@@ -0,0 +1,473 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func doHandshake(t *testing.T, c net.Conn, path string) *fasthttp.Response {
+	t.Helper()
+
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n",
+		path, makeRandKey(nil))
+
+	res := &fasthttp.Response{}
+	if err := res.Read(bufio.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func serveHandshake(t *testing.T, ws *Server) (net.Conn, func()) {
+	t.Helper()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+		ln.Close()
+	}
+}
+
+func serveNetHandshake(t *testing.T, ws *Server) (net.Conn, func()) {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+		s.Close()
+	}
+}
+
+func checkUpgradeResponse(t *testing.T, res *fasthttp.Response) {
+	t.Helper()
+
+	if res.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code: %d", res.StatusCode())
+	}
+	if v := res.Header.Peek("X-Session"); string(v) != "1234" {
+		t.Fatalf("unexpected X-Session header: %s", v)
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+
+	cookie.SetKey("session")
+	if !res.Header.Cookie(cookie) || string(cookie.Value()) != "abc" {
+		t.Fatalf("unexpected session cookie: %s", cookie.Value())
+	}
+}
+
+func checkRejectResponse(t *testing.T, res *fasthttp.Response, status int, body string) {
+	t.Helper()
+
+	if res.StatusCode() != status {
+		t.Fatalf("unexpected status code: %d<>%d", res.StatusCode(), status)
+	}
+	if b := string(res.Body()); body != "" && b != body {
+		t.Fatalf("unexpected body: %q<>%q", b, body)
+	}
+}
+
+func TestUpgradeResponseHeaders(t *testing.T) {
+	ws := &Server{
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			ctx.Response.Header.Set("X-Session", "1234")
+
+			cookie := fasthttp.AcquireCookie()
+			cookie.SetKey("session")
+			cookie.SetValue("abc")
+			ctx.Response.Header.SetCookie(cookie)
+			fasthttp.ReleaseCookie(cookie)
+
+			return true
+		},
+	}
+
+	c, closer := serveHandshake(t, ws)
+	defer closer()
+
+	checkUpgradeResponse(t, doHandshake(t, c, "/"))
+}
+
+func TestNetUpgradeResponseHeaders(t *testing.T) {
+	ws := &Server{
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			resp.Header().Set("X-Session", "1234")
+			http.SetCookie(resp, &http.Cookie{Name: "session", Value: "abc"})
+
+			return true
+		},
+	}
+
+	c, closer := serveNetHandshake(t, ws)
+	defer closer()
+
+	checkUpgradeResponse(t, doHandshake(t, c, "/"))
+}
+
+func TestUpgradeReject(t *testing.T) {
+	ws := &Server{
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			if string(ctx.Path()) == "/private" {
+				ctx.Error("unauthorized", fasthttp.StatusUnauthorized)
+			}
+
+			return false
+		},
+	}
+
+	c, closer := serveHandshake(t, ws)
+	defer closer()
+
+	checkRejectResponse(t, doHandshake(t, c, "/private"), fasthttp.StatusUnauthorized, "unauthorized")
+	checkRejectResponse(t, doHandshake(t, c, "/"), fasthttp.StatusForbidden, "")
+}
+
+func TestNetUpgradeReject(t *testing.T) {
+	ws := &Server{
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			if req.URL.Path == "/private" {
+				resp.WriteHeader(http.StatusUnauthorized)
+				resp.Write([]byte("unauthorized"))
+			}
+
+			return false
+		},
+	}
+
+	c, closer := serveNetHandshake(t, ws)
+	defer closer()
+
+	checkRejectResponse(t, doHandshake(t, c, "/private"), http.StatusUnauthorized, "unauthorized")
+	checkRejectResponse(t, doHandshake(t, c, "/"), http.StatusForbidden, "")
+}
+
+func pipelinedUpgrade(t *testing.T, c net.Conn, text string) {
+	t.Helper()
+
+	var bf bytes.Buffer
+
+	fmt.Fprintf(&bf, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n",
+		makeRandKey(nil))
+
+	fr := AcquireFrame()
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte(text))
+	fr.Mask()
+	fr.WriteTo(&bf)
+	ReleaseFrame(fr)
+
+	// handshake and frame must arrive together
+	if _, err := c.Write(bf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPipelinedFrames(t *testing.T, serve func(*testing.T, *Server) (net.Conn, func())) {
+	text := "pipelined message"
+	ch := make(chan string, 1)
+
+	ws := &Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	c, closer := serve(t, ws)
+	defer closer()
+
+	go io.Copy(io.Discard, c)
+
+	pipelinedUpgrade(t, c, text)
+
+	select {
+	case data := <-ch:
+		if data != text {
+			t.Fatalf("%s <> %s", data, text)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestUpgradePipelinedFrames(t *testing.T) {
+	testPipelinedFrames(t, serveHandshake)
+}
+
+func TestNetUpgradePipelinedFrames(t *testing.T) {
+	testPipelinedFrames(t, serveNetHandshake)
+}
+
+func testInvalidFrame(t *testing.T, serve func(*testing.T, *Server) (net.Conn, func())) {
+	closed := make(chan CloseInfo, 1)
+
+	ws := &Server{}
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- info
+	})
+
+	c, closer := serve(t, ws)
+	defer closer()
+
+	if res := doHandshake(t, c, "/"); res.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code: %d", res.StatusCode())
+	}
+
+	// a masked close frame holding 1 byte
+	c.Write([]byte{0x88, 0x81, 0, 0, 0, 0, 'x'})
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(c); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsClose() || fr.Status() != StatusProtocolError {
+		t.Fatalf("unexpected frame %s: %d", fr.Code(), fr.Status())
+	}
+
+	select {
+	case info := <-closed:
+		if info.Remote || info.Status != StatusProtocolError {
+			t.Fatalf("unexpected close: %+v", info)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestUpgradeInvalidFrame(t *testing.T) {
+	testInvalidFrame(t, serveHandshake)
+}
+
+func TestNetUpgradeInvalidFrame(t *testing.T) {
+	testInvalidFrame(t, serveNetHandshake)
+}
+
+func TestHandleStream(t *testing.T) {
+	ch := make(chan string, 1)
+
+	ws := &Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		t.Error("MessageHandler must not be called")
+	})
+	ws.HandleStream(func(c *Conn, isBinary bool, r io.Reader) {
+		if !isBinary {
+			t.Error("expected binary message")
+		}
+
+		var bf bytes.Buffer
+		if _, err := io.Copy(&bf, r); err != nil {
+			t.Error(err)
+		}
+
+		ch <- bf.String()
+	})
+
+	c, closer := serveHandshake(t, ws)
+	defer closer()
+
+	res := doHandshake(t, c, "/")
+	if res.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code: %d", res.StatusCode())
+	}
+
+	conn := &Client{
+		c: c,
+		brw: bufio.NewReadWriter(
+			bufio.NewReader(c), bufio.NewWriter(c)),
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetPayload([]byte("streamed "))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	// control frames are handled in between
+	fr.Reset()
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload([]byte("ping"))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	fr.Reset()
+	fr.SetContinuation()
+	fr.SetFin()
+	fr.SetPayload([]byte("message"))
+	fr.Mask()
+	conn.WriteFrame(fr)
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsPong() {
+		t.Fatalf("expected pong, got %s", fr.Code())
+	}
+
+	select {
+	case data := <-ch:
+		if data != "streamed message" {
+			t.Fatalf("unexpected message: %s", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+// closeInfoServer returns a Server reporting the close details on closed.
+//
+// The server closes the connection when receiving "close".
+func closeInfoServer(t *testing.T, closed chan<- CloseInfo) *Server {
+	ws := &Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "close" {
+			c.CloseDetail(StatusGoAway, "shutdown")
+		}
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		if info != c.CloseInfo() {
+			t.Errorf("unexpected Conn.CloseInfo: %+v", c.CloseInfo())
+		}
+
+		closed <- info
+	})
+
+	return ws
+}
+
+func dialCloseInfo(t *testing.T, closed chan<- CloseInfo) *Client {
+	t.Helper()
+
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+
+	s := fasthttp.Server{
+		Handler: closeInfoServer(t, closed).Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func waitCloseInfo(t *testing.T, closed <-chan CloseInfo) CloseInfo {
+	t.Helper()
+
+	select {
+	case info := <-closed:
+		if info.Duration <= 0 {
+			t.Fatalf("unexpected duration: %s", info.Duration)
+		}
+
+		return info
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	return CloseInfo{}
+}
+
+func TestCloseInfoRemote(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+	conn := dialCloseInfo(t, closed)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusCode(4000))
+	fr.SetPayload([]byte("bye"))
+	fr.Mask()
+
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	info := waitCloseInfo(t, closed)
+	if info.Status != 4000 || info.Reason != "bye" || !info.Remote ||
+		!info.Handshake || info.ReplyStatus != 4000 || info.Err != nil {
+		t.Fatalf("unexpected close: %+v", info)
+	}
+
+	// the reply is written before the server closes the connection
+	conn.c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsClose() || fr.Status() != 4000 {
+		t.Fatalf("unexpected frame %s: %d", fr.Code(), fr.Status())
+	}
+
+	conn.Shutdown()
+}
+
+func TestCloseInfoLocal(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+	conn := dialCloseInfo(t, closed)
+	defer conn.Close()
+
+	io.WriteString(conn, "close")
+
+	info := waitCloseInfo(t, closed)
+	if info.Status != StatusGoAway || info.Reason != "shutdown" || info.Remote || info.Err != nil {
+		t.Fatalf("unexpected close: %+v", info)
+	}
+}
+
+func TestCloseInfoDropped(t *testing.T) {
+	closed := make(chan CloseInfo, 1)
+	conn := dialCloseInfo(t, closed)
+
+	conn.Shutdown()
+
+	info := waitCloseInfo(t, closed)
+	if info.Err == nil || !info.Remote || info.Handshake || info.Status != 0 {
+		t.Fatalf("unexpected close: %+v", info)
+	}
+}
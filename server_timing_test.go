@@ -1,6 +1,8 @@
 package websocket
 
 import (
+	"bufio"
+	"fmt"
 	"io"
 	"net"
 	"runtime"
@@ -196,3 +198,188 @@ func Benchmark10000FastMsgsPerConn(b *testing.B) {
 func Benchmark100000FastMsgsPerConn(b *testing.B) {
 	benchmarkFastServer(b, runtime.NumCPU(), 100000)
 }
+
+// idleTransport returns a func opening the client side of a connection served by ws.
+type idleTransport func(b *testing.B, ws *Server) func() net.Conn
+
+// pipeTransport serves the connections over net.Pipe without handshake.
+func pipeTransport(b *testing.B, ws *Server) func() net.Conn {
+	ws.once.Do(ws.initServer)
+
+	return func() net.Conn {
+		c, sc := net.Pipe()
+
+		go ws.serve(acquireConn(sc, sc))
+
+		return c
+	}
+}
+
+// tcpTransport upgrades the connections over TCP, using netpoll if requested.
+func tcpTransport(netpoll bool) idleTransport {
+	return func(b *testing.B, ws *Server) func() net.Conn {
+		if netpoll {
+			if err := ws.EnableNetpoll(0); err != nil {
+				b.Skip(err)
+			}
+			b.Cleanup(ws.StopNetpoll)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { ln.Close() })
+
+		s := fasthttp.Server{
+			Handler:           ws.Upgrade,
+			KeepHijackedConns: true,
+		}
+		go s.Serve(ln)
+
+		return func() net.Conn {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n",
+				makeRandKey(nil))
+
+			var res fasthttp.Response
+			if err := res.Read(bufio.NewReaderSize(c, 512)); err != nil {
+				b.Fatal(err)
+			}
+
+			return c
+		}
+	}
+}
+
+// benchmarkIdleConns reports the server memory used per idle connection.
+func benchmarkIdleConns(b *testing.B, conns int, transport idleTransport) {
+	var (
+		opened = make(chan struct{}, conns)
+		closed = make(chan struct{}, conns)
+	)
+
+	ws := &Server{}
+	ws.HandleOpen(func(c *Conn) {
+		opened <- struct{}{}
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- struct{}{}
+	})
+
+	dial := transport(b, ws)
+
+	var perConn float64
+
+	cs := make([]net.Conn, conns)
+
+	for i := 0; i < b.N; i++ {
+		before := memoryInUse()
+
+		for i := range cs {
+			cs[i] = dial()
+		}
+		for range cs {
+			<-opened
+		}
+
+		// let the connections wait for the frames
+		time.Sleep(time.Millisecond * 100)
+
+		perConn += float64(memoryInUse()-before) / float64(conns)
+
+		for _, c := range cs {
+			c.Close()
+		}
+		for range cs {
+			<-closed
+		}
+	}
+
+	b.ReportMetric(perConn/float64(b.N), "B/conn")
+}
+
+// BenchmarkIdleConns reports the memory used per idle connection
+// served using goroutines or netpoll.
+func BenchmarkIdleConns(b *testing.B) {
+	b.Run("pipe", func(b *testing.B) {
+		benchmarkIdleConns(b, 100000, pipeTransport)
+	})
+	b.Run("tcp", func(b *testing.B) {
+		benchmarkIdleConns(b, 1000, tcpTransport(false))
+	})
+	b.Run("tcp-netpoll", func(b *testing.B) {
+		benchmarkIdleConns(b, 1000, tcpTransport(true))
+	})
+}
+
+func memoryInUse() int64 {
+	runtime.GC()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return int64(ms.HeapInuse + ms.StackInuse)
+}
+
+func benchmarkBroadcastBurst(b *testing.B, batchSize int) {
+	const burst = 100
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cc := newCountingConn(nc)
+
+	c := acquireConn(cc, cc)
+	c.writeBatchSize = batchSize
+	c.start()
+
+	msg := []byte("broadcast message")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg) * burst))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burst; j++ {
+			c.Write(msg)
+		}
+	}
+
+	// the queued frames are written before closing
+	c.CloseDetail(StatusGoAway, "")
+	c.wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&cc.writes))/float64(b.N*burst), "writes/frame")
+}
+
+// BenchmarkBroadcastBurst reports the writes performed when sending bursts of messages.
+func BenchmarkBroadcastBurst(b *testing.B) {
+	b.Run("unbatched", func(b *testing.B) {
+		benchmarkBroadcastBurst(b, 1)
+	})
+	b.Run("batched", func(b *testing.B) {
+		benchmarkBroadcastBurst(b, DefaultWriteBatchSize)
+	})
+}
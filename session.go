@@ -0,0 +1,66 @@
+package websocket
+
+// UserValue returns the key associated value.
+//
+// The user values of the upgrade request are returned too.
+func (c *Conn) UserValue(key string) interface{} {
+	c.mu.RLock()
+	v, ok := c.values[key]
+	c.mu.RUnlock()
+
+	if ok {
+		return v
+	}
+
+	return c.ctx.Value(key)
+}
+
+// SetUserValue assigns a key to the given value.
+//
+// SetUserValue is safe for concurrent use.
+func (c *Conn) SetUserValue(key string, value interface{}) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+	c.mu.Unlock()
+}
+
+// DeleteUserValue removes the value assigned to key using SetUserValue.
+func (c *Conn) DeleteUserValue(key string) {
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+// UserValueOf returns the value assigned to key if it is of type T.
+//
+// ok is false if the key has no value or the value is not of type T.
+func UserValueOf[T any](c *Conn, key string) (v T, ok bool) {
+	v, ok = c.UserValue(key).(T)
+	return v, ok
+}
+
+// SetSession attaches the session s to c replacing the previous one.
+//
+// The session is usually attached in the OpenHandler and retrieved
+// in the other handlers using SessionOf with the same type.
+//
+// SetSession is safe for concurrent use.
+func SetSession[T any](c *Conn, s T) {
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+}
+
+// SessionOf returns the session attached to c using SetSession.
+//
+// ok is false if no session of type T is attached.
+func SessionOf[T any](c *Conn) (s T, ok bool) {
+	c.mu.RLock()
+	s, ok = c.session.(T)
+	c.mu.RUnlock()
+
+	return s, ok
+}
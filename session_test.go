@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+type testSession struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func TestUserValueOf(t *testing.T) {
+	c := acquireConn(nil, nil)
+
+	c.SetUserValue("count", 1)
+
+	if v, ok := UserValueOf[int](c, "count"); !ok || v != 1 {
+		t.Fatalf("unexpected value: %v %v", v, ok)
+	}
+	if _, ok := UserValueOf[string](c, "count"); ok {
+		t.Fatal("unexpected value of type string")
+	}
+
+	c.DeleteUserValue("count")
+
+	if _, ok := UserValueOf[int](c, "count"); ok {
+		t.Fatal("value not deleted")
+	}
+	if v := c.UserValue("count"); v != nil {
+		t.Fatalf("unexpected value: %v", v)
+	}
+}
+
+func TestSession(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	closed := make(chan *testSession, 1)
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		if _, ok := SessionOf[*testSession](c); ok {
+			t.Error("unexpected session")
+		}
+
+		SetSession(c, &testSession{})
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		s, ok := SessionOf[*testSession](c)
+		if !ok {
+			t.Error("session not found")
+			return
+		}
+
+		s.mu.Lock()
+		s.messages = append(s.messages, string(data))
+		s.mu.Unlock()
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		s, _ := SessionOf[*testSession](c)
+		closed <- s
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("Hello"))
+	conn.Write([]byte("world"))
+	conn.Close()
+
+	select {
+	case s := <-closed:
+		if s == nil || len(s.messages) != 2 || s.messages[0] != "Hello" || s.messages[1] != "world" {
+			t.Fatalf("unexpected session: %+v", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,266 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Tracer traces the handshakes and the lifecycle of the connections
+// without depending on any tracing SDK.
+//
+// Wrapping an OpenTelemetry tracer, Start starts a span from the span
+// held by ctx while Extract and Inject use the trace context propagator.
+type Tracer interface {
+	// Start starts a span named name as a child of the span held by ctx
+	// returning the context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Extract returns ctx holding the trace context found in carrier, if any.
+	Extract(ctx context.Context, carrier Carrier) context.Context
+	// Inject sets the trace context held by ctx into carrier.
+	Inject(ctx context.Context, carrier Carrier)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute describing the operation.
+	SetAttribute(key string, value interface{})
+	// RecordError records the error failing the operation.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// Carrier holds the headers of a handshake request propagating
+// the trace context (like OpenTelemetry's TextMapCarrier).
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// The names of the spans.
+const (
+	// SpanHandshake traces the handshake, either upgrading a request or as client.
+	SpanHandshake = "websocket.handshake"
+	// SpanMessage traces a message handled by the MessageHandler or the StreamHandler.
+	SpanMessage = "websocket.message"
+	// SpanClose traces the closure of a connection and its CloseHandler.
+	SpanClose = "websocket.close"
+)
+
+// The attributes set on the spans.
+const (
+	AttrRole          = "websocket.role"
+	AttrSubprotocol   = "websocket.subprotocol"
+	AttrConnID        = "websocket.conn.id"
+	AttrMessageType   = "websocket.message.type"
+	AttrMessageSize   = "websocket.message.size"
+	AttrCloseStatus   = "websocket.close.status"
+	AttrCloseReason   = "websocket.close.reason"
+	AttrCloseRemote   = "websocket.close.remote"
+	AttrCloseDuration = "websocket.close.duration"
+)
+
+// startHandshake starts the span of a handshake.
+func startHandshake(tr Tracer, ctx context.Context, role Role) (context.Context, Span) {
+	ctx, span := tr.Start(ctx, SpanHandshake)
+	span.SetAttribute(AttrRole, role.String())
+
+	return ctx, span
+}
+
+// endSpan ends span recording err if any.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	span.End()
+}
+
+// messageType returns the AttrMessageType of a message.
+func messageType(isBinary bool) string {
+	if isBinary {
+		return "binary"
+	}
+
+	return "text"
+}
+
+// noopSpan is the span of the operations when no Tracer is defined.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// headerCarrier adapts the net/http headers to Carrier.
+type headerCarrier http.Header
+
+func (h headerCarrier) Get(key string) string {
+	return http.Header(h).Get(key)
+}
+
+func (h headerCarrier) Set(key, value string) {
+	http.Header(h).Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// requestHeaderCarrier adapts the fasthttp request headers to Carrier.
+type requestHeaderCarrier struct {
+	h *fasthttp.RequestHeader
+}
+
+func (c requestHeaderCarrier) Get(key string) string {
+	return string(c.h.Peek(key))
+}
+
+func (c requestHeaderCarrier) Set(key, value string) {
+	c.h.Set(key, value)
+}
+
+func (c requestHeaderCarrier) Keys() (keys []string) {
+	c.h.VisitAll(func(k, v []byte) {
+		keys = append(keys, string(k))
+	})
+
+	return keys
+}
+
+// TraceRecorder is a Tracer recording the spans in memory, meant for tests.
+//
+// The trace context is propagated using the W3C traceparent header.
+type TraceRecorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// RecordedSpan is a span ended using a TraceRecorder.
+type RecordedSpan struct {
+	Name string
+	// TraceID and SpanID are hex encoded, ParentID is empty for the root spans.
+	TraceID  string
+	SpanID   string
+	ParentID string
+
+	Attributes map[string]interface{}
+	Err        error
+
+	Start time.Time
+	End   time.Time
+}
+
+var _ Tracer = (*TraceRecorder)(nil)
+
+// traceparentHeader is the header propagating the trace context.
+const traceparentHeader = "traceparent"
+
+type spanContextKey struct{}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+// Start implements Tracer.
+func (tr *TraceRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recorderSpan{
+		tr: tr,
+		RecordedSpan: RecordedSpan{
+			Name:       name,
+			SpanID:     randomHex(8),
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		span.TraceID = parent.traceID
+		span.ParentID = parent.spanID
+	} else {
+		span.TraceID = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{
+		traceID: span.TraceID,
+		spanID:  span.SpanID,
+	}), span
+}
+
+// Extract implements Tracer.
+func (tr *TraceRecorder) Extract(ctx context.Context, carrier Carrier) context.Context {
+	// version-traceid-parentid-flags
+	parts := strings.Split(carrier.Get(traceparentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{
+		traceID: parts[1],
+		spanID:  parts[2],
+	})
+}
+
+// Inject implements Tracer.
+func (tr *TraceRecorder) Inject(ctx context.Context, carrier Carrier) {
+	if sc, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		carrier.Set(traceparentHeader, "00-"+sc.traceID+"-"+sc.spanID+"-01")
+	}
+}
+
+// Spans returns the spans ended so far.
+func (tr *TraceRecorder) Spans() []RecordedSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return append([]RecordedSpan(nil), tr.spans...)
+}
+
+// recorderSpan is a span started by a TraceRecorder.
+type recorderSpan struct {
+	tr *TraceRecorder
+	RecordedSpan
+	ended bool
+}
+
+func (span *recorderSpan) SetAttribute(key string, value interface{}) {
+	span.Attributes[key] = value
+}
+
+func (span *recorderSpan) RecordError(err error) {
+	span.Err = err
+}
+
+func (span *recorderSpan) End() {
+	if span.ended {
+		return
+	}
+	span.ended = true
+	span.RecordedSpan.End = time.Now()
+
+	span.tr.mu.Lock()
+	span.tr.spans = append(span.tr.spans, span.RecordedSpan)
+	span.tr.mu.Unlock()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// waitSpans waits for tr to record n spans returning them by name.
+func waitSpans(t *testing.T, tr *TraceRecorder, n int) map[string]RecordedSpan {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(tr.Spans()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d spans, got %d", n, len(tr.Spans()))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	spans := make(map[string]RecordedSpan)
+	for _, span := range tr.Spans() {
+		spans[span.Name] = span
+	}
+
+	return spans
+}
+
+func TestServerTrace(t *testing.T) {
+	var rec, crec TraceRecorder
+
+	var (
+		opened  = make(chan context.Context, 1)
+		handled = make(chan struct{}, 1)
+		closed  = make(chan struct{}, 1)
+	)
+
+	ws := Server{
+		Tracer: &rec,
+	}
+	ws.HandleOpen(func(c *Conn) {
+		opened <- c.Context()
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		handled <- struct{}{}
+	})
+	ws.HandleClose(func(c *Conn, info CloseInfo) {
+		closed <- struct{}{}
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Dialer{
+		Tracer: &crec,
+	}
+
+	conn, err := d.Client(c, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := <-opened
+
+	io.WriteString(conn, "hello")
+	<-handled
+
+	conn.Close()
+	<-closed
+
+	client := waitSpans(t, &crec, 1)[SpanHandshake]
+	if client.Attributes[AttrRole] != "client" || client.Err != nil {
+		t.Fatalf("unexpected client span: %+v", client)
+	}
+
+	spans := waitSpans(t, &rec, 3)
+
+	// the trace context is propagated by the client
+	handshake := spans[SpanHandshake]
+	if handshake.TraceID != client.TraceID || handshake.ParentID != client.SpanID ||
+		handshake.Attributes[AttrRole] != "server" || handshake.Err != nil {
+		t.Fatalf("unexpected handshake span: %+v", handshake)
+	}
+
+	msg := spans[SpanMessage]
+	if msg.ParentID != handshake.SpanID || msg.Attributes[AttrMessageType] != "text" ||
+		msg.Attributes[AttrMessageSize] != 5 {
+		t.Fatalf("unexpected message span: %+v", msg)
+	}
+
+	cl := spans[SpanClose]
+	if cl.ParentID != handshake.SpanID || cl.Attributes[AttrCloseStatus] != int(StatusNone) ||
+		cl.Attributes[AttrCloseRemote] != true || cl.Err != nil {
+		t.Fatalf("unexpected close span: %+v", cl)
+	}
+
+	// the spans started from the Conn context belong to the trace of the connection
+	_, span := rec.Start(ctx, "custom")
+	span.End()
+
+	if custom := waitSpans(t, &rec, 4)["custom"]; custom.TraceID != handshake.TraceID {
+		t.Fatalf("unexpected trace: %s <> %s", custom.TraceID, handshake.TraceID)
+	}
+}
+
+func TestUpgradeAsClientTrace(t *testing.T) {
+	var rec TraceRecorder
+
+	ws := Server{}
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	d := Dialer{
+		Tracer: &rec,
+	}
+
+	if err := d.UpgradeAsClient(c, "http://localhost/", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := waitSpans(t, &rec, 1)[SpanHandshake]
+	if handshake.Attributes[AttrRole] != "client" || handshake.Err != nil {
+		t.Fatalf("unexpected handshake span: %+v", handshake)
+	}
+}
+
+func TestNetUpgradeTrace(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+
+	var rec TraceRecorder
+
+	opened := make(chan context.Context, 1)
+
+	ws := Server{
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			return req.URL.Path != "/private"
+		},
+		Tracer: &rec,
+	}
+	ws.HandleOpen(func(c *Conn) {
+		opened <- c.Context()
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+
+	conn, err := DialWithHeaders(url+"/", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	handshake := waitSpans(t, &rec, 1)[SpanHandshake]
+	if handshake.TraceID != traceID || handshake.ParentID != parentID || handshake.Err != nil {
+		t.Fatalf("unexpected handshake span: %+v", handshake)
+	}
+
+	sc, ok := (<-opened).Value(spanContextKey{}).(spanContext)
+	if !ok || sc.spanID != handshake.SpanID {
+		t.Fatalf("unexpected Conn trace context: %+v", sc)
+	}
+
+	// the rejected handshakes are traced too
+	if _, err := Dial(url + "/private"); err == nil {
+		t.Fatal("expected rejection")
+	}
+
+	waitSpans(t, &rec, 2)
+
+	rejected := rec.Spans()[1]
+	if rejected.Name != SpanHandshake || rejected.Err != ErrUpgradeRejected || rejected.ParentID != "" {
+		t.Fatalf("unexpected rejected span: %+v", rejected)
+	}
+}
@@ -1,13 +1,19 @@
 package websocket
 
 import (
-
+	"bytes"
+	"context"
 	// #nosec G505
 	"crypto/sha1"
 	b64 "encoding/base64"
+	"errors"
 	"hash"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/valyala/fasthttp"
 )
@@ -18,11 +24,424 @@ type (
 	// UpgradeHandler is a middleware callback that determines whether the
 	// WebSocket connection should be upgraded or not. If UpgradeHandler returns false,
 	// the connection is not upgraded.
+	//
+	// Headers and cookies set on ctx.Response are sent along with the
+	// switching protocols response. When rejecting, the status code and body
+	// set on ctx.Response are sent to the peer. If none was set,
+	// the peer receives a 403 Forbidden.
 	UpgradeHandler func(*fasthttp.RequestCtx) bool
 	// UpgradeNetHandler is like UpgradeHandler but for net/http.
+	//
+	// Headers and cookies set on resp.Header() are sent along with the
+	// switching protocols response. When rejecting, the status code and body
+	// written to resp are sent to the peer. If nothing was written,
+	// the peer receives a 403 Forbidden.
 	UpgradeNetHandler func(resp http.ResponseWriter, req *http.Request) bool
 )
 
+var (
+	// ErrOriginNotAllowed is returned when the Origin header doesn't match the expected origin.
+	ErrOriginNotAllowed = errors.New("origin not allowed")
+	// ErrVersionNotSupported is returned when the peer requests an unsupported WebSocket version.
+	ErrVersionNotSupported = errors.New("websocket version not supported")
+	// ErrUpgradeRejected is returned when the upgrade handler rejects the connection.
+	ErrUpgradeRejected = errors.New("upgrade rejected")
+)
+
+// Upgrader upgrades HTTP requests to WebSocket connections
+// handing over the Conn to the caller.
+//
+// Unlike Server, the connection is not served using callbacks.
+// The frames must be read using Conn.ReadMessage or Conn.NextReader.
+//
+// UpgradeHTTP returns the Conn, but Upgrade cannot: fasthttp hijacks the
+// connection once the request handler has returned. Upgrade takes
+// a RequestHandler running the sequential logic with the Conn instead.
+type Upgrader struct {
+	// UpgradeHandler allows the user to handle RequestCtx when upgrading for fasthttp.
+	//
+	// If UpgradeHandler returns false the connection won't be upgraded.
+	UpgradeHandler UpgradeHandler
+
+	// UpgradeNetHandler allows the user to handle the request when upgrading for net/http.
+	//
+	// If UpgradeNetHandler returns false, the connection won't be upgraded.
+	UpgradeNetHandler UpgradeNetHandler
+
+	// Protocols are the supported protocols.
+	Protocols []string
+
+	// Origin is used to limit the clients coming from the defined origin
+	Origin string
+
+	// Tracer traces the handshakes if defined.
+	//
+	// The trace context is extracted from the request headers and
+	// the Conn context holds the span of the handshake.
+	Tracer Tracer
+
+	// selectProto selects the subprotocol instead of Protocols when defined.
+	selectProto func(protos [][]byte) string
+
+	nextID uint64
+}
+
+// Upgrade upgrades the fasthttp request running handler once the connection
+// has been hijacked.
+//
+// fasthttp hijacks the connection after the request handler returns,
+// thus the connection can only be used inside handler.
+// The connection is closed when handler returns.
+func (u *Upgrader) Upgrade(ctx *fasthttp.RequestCtx, handler RequestHandler) error {
+	return u.upgrade(ctx, func(c *Conn) {
+		c.id = atomic.AddUint64(&u.nextID, 1)
+		c.start()
+
+		handler(c)
+
+		c.Close()
+		c.wg.Wait()
+	})
+}
+
+// UpgradeHTTP upgrades the net/http request returning the WebSocket connection.
+//
+// The caller is in charge of closing the connection.
+//
+// HTTP/2 extended CONNECT requests (RFC 8441) are upgraded too. In that case
+// the connection is bound to the request, so the handler must not return
+// until the connection is closed.
+func (u *Upgrader) UpgradeHTTP(resp http.ResponseWriter, req *http.Request) (*Conn, error) {
+	c, err := u.upgradeHTTP(resp, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.id = atomic.AddUint64(&u.nextID, 1)
+	c.start()
+
+	return c, nil
+}
+
+// upgrade performs the handshake calling handler with the Conn
+// inside the hijack handler.
+func (u *Upgrader) upgrade(ctx *fasthttp.RequestCtx, handler func(c *Conn)) (err error) {
+	tctx, span := context.Background(), Span(noopSpan{})
+	if u.Tracer != nil {
+		tctx = u.Tracer.Extract(tctx, requestHeaderCarrier{&ctx.Request.Header})
+		tctx, span = startHandshake(u.Tracer, tctx, RoleServer)
+	}
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if !ctx.IsGet() {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return ErrCannotUpgrade
+	}
+
+	// Checking Origin header if needed
+	if !u.checkOrigin(ctx.Request.Header.Peek("Origin")) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		return ErrOriginNotAllowed
+	}
+
+	// Normalizing must be disabled because of WebSocket header fields.
+	// (This is not a fasthttp bug).
+	ctx.Response.Header.DisableNormalizing()
+
+	// Connection.Value == Upgrade
+	if !ctx.Request.Header.ConnectionUpgrade() {
+		return ErrCannotUpgrade
+	}
+
+	// Peek sade header field.
+	hup := ctx.Request.Header.PeekBytes(upgradeString)
+	// Compare with websocket string defined by the RFC
+	if !equalsFold(hup, websocketString) {
+		return ErrCannotUpgrade
+	}
+	// Peeking websocket key.
+	hkey := ctx.Request.Header.PeekBytes(wsHeaderKey)
+	hprotos := splitProtocols(ctx.Request.Header.PeekBytes(wsHeaderProtocol))
+
+	// Checking websocket version
+	if !supportedVersion(ctx.Request.Header.PeekBytes(wsHeaderVersion)) {
+		ctx.Error("Versions not supported", fasthttp.StatusBadRequest)
+		return ErrVersionNotSupported
+	}
+
+	if u.UpgradeHandler != nil {
+		if !u.UpgradeHandler(ctx) {
+			if ctx.Response.StatusCode() == fasthttp.StatusOK {
+				ctx.Error(fasthttp.StatusMessage(fasthttp.StatusForbidden), fasthttp.StatusForbidden)
+			}
+			return ErrUpgradeRejected
+		}
+	}
+	// TODO: compression
+	// compress := mustCompress(exts)
+
+	// Setting response headers
+	ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	ctx.Response.Header.AddBytesKV(connectionString, upgradeString)
+	ctx.Response.Header.AddBytesKV(upgradeString, websocketString)
+	ctx.Response.Header.AddBytesKV(wsHeaderAccept, makeKey(hkey, hkey))
+
+	// TODO: implement bad websocket version
+	// https://tools.ietf.org/html/rfc6455#section-4.4
+	proto := u.selectProtocol(hprotos)
+	if proto != "" {
+		ctx.Response.Header.AddBytesK(wsHeaderProtocol, proto)
+	}
+	if u.Tracer != nil {
+		span.SetAttribute(AttrSubprotocol, proto)
+	}
+
+	// the RequestCtx must not be used inside the hijack handler
+	header := &fasthttp.RequestHeader{}
+	ctx.Request.Header.CopyTo(header)
+	tlsState := ctx.TLSConnectionState()
+
+	nctx := tctx
+	ctx.VisitUserValues(func(k []byte, v interface{}) {
+		//nolint:staticcheck
+		nctx = context.WithValue(nctx, string(k), v)
+	})
+
+	ctx.Hijack(func(c net.Conn) {
+		// reading from the hijacked conn consumes the data buffered by fasthttp first.
+		r := io.Reader(c)
+		if nc, ok := c.(interface {
+			UnsafeConn() net.Conn
+		}); ok {
+			c = nc.UnsafeConn()
+		}
+
+		conn := acquireConn(c, r)
+		// establishing default options
+		conn.ctx = nctx
+		conn.header = header
+		conn.tlsState = tlsState
+		conn.proto = proto
+
+		handler(conn)
+	})
+
+	return nil
+}
+
+// upgradeHTTP performs the handshake returning the Conn.
+func (u *Upgrader) upgradeHTTP(resp http.ResponseWriter, req *http.Request) (c *Conn, err error) {
+	if u.Tracer != nil {
+		ctx := u.Tracer.Extract(req.Context(), headerCarrier(req.Header))
+		ctx, span := startHandshake(u.Tracer, ctx, RoleServer)
+
+		defer func() {
+			if c != nil {
+				span.SetAttribute(AttrSubprotocol, c.proto)
+			}
+
+			endSpan(span, err)
+		}()
+
+		// the Conn context is the request context
+		req = req.WithContext(ctx)
+	}
+
+	return u.handshakeHTTP(resp, req)
+}
+
+// handshakeHTTP performs the handshake of upgradeHTTP.
+func (u *Upgrader) handshakeHTTP(resp http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if isExtendedConnect(req) {
+		return u.upgradeH2(resp, req)
+	}
+
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return nil, ErrCannotUpgrade
+	}
+
+	rs := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(rs)
+
+	// Checking Origin header if needed
+	if !u.checkNetOrigin(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return nil, ErrOriginNotAllowed
+	}
+
+	// Normalizing must be disabled because of WebSocket header fields.
+	// (This is not a fasthttp bug).
+	rs.Header.DisableNormalizing()
+
+	hasUpgrade := false
+	for _, v := range req.Header["Connection"] {
+		if strings.Contains(v, "Upgrade") {
+			hasUpgrade = true
+
+			break
+		}
+	}
+
+	// Connection.Value == Upgrade
+	if !hasUpgrade {
+		return nil, ErrCannotUpgrade
+	}
+	// Peek sade header field.
+	hup := req.Header.Get("Upgrade")
+	// Compare with websocket string defined by the RFC
+	if !equalsFold(s2b(hup), websocketString) {
+		return nil, ErrCannotUpgrade
+	}
+	// Peeking websocket key.
+	hkey := req.Header.Get(b2s(wsHeaderKey))
+
+	hprotos, err := u.acceptNet(resp, req)
+	if err != nil {
+		return nil, err
+	}
+	// TODO: compression
+
+	h, ok := resp.(http.Hijacker)
+	if !ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return nil, ErrCannotUpgrade
+	}
+
+	c, brw, err := h.Hijack()
+	if err != nil {
+		io.WriteString(resp, err.Error())
+		return nil, err
+	}
+
+	// Setting response headers
+	for k, vs := range resp.Header() {
+		for _, v := range vs {
+			rs.Header.Add(k, v)
+		}
+	}
+	rs.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	rs.Header.AddBytesKV(connectionString, upgradeString)
+	rs.Header.AddBytesKV(upgradeString, websocketString)
+	rs.Header.AddBytesKV(wsHeaderAccept, makeKey(s2b(hkey), s2b(hkey)))
+	// TODO: implement bad websocket version
+	// https://tools.ietf.org/html/rfc6455#section-4.4
+	proto := u.selectProtocol(hprotos)
+	if proto != "" {
+		rs.Header.AddBytesK(wsHeaderProtocol, proto)
+	}
+
+	_, err = rs.WriteTo(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// brw.Reader may contain frames sent right after the handshake.
+	return newNetConn(c, brw.Reader, req, proto), nil
+}
+
+// checkOrigin checks the Origin header value if Upgrader.Origin is defined.
+func (u *Upgrader) checkOrigin(origin []byte) bool {
+	if u.Origin == "" {
+		return true
+	}
+
+	uri := fasthttp.AcquireURI()
+	uri.Update(u.Origin)
+
+	b := bytePool.Get().([]byte)
+	b = prepareOrigin(b, uri)
+	fasthttp.ReleaseURI(uri)
+
+	ok := equalsFold(b, origin)
+	//nolint:staticcheck
+	bytePool.Put(b)
+
+	return ok
+}
+
+// checkNetOrigin checks the Origin header of req if Upgrader.Origin is defined.
+func (u *Upgrader) checkNetOrigin(req *http.Request) bool {
+	return u.checkOrigin(s2b(req.Header.Get("Origin")))
+}
+
+// acceptNet checks the websocket version of req and runs the UpgradeNetHandler,
+// returning the subprotocols requested by the peer.
+//
+// The error response is written to resp if the request is not accepted.
+func (u *Upgrader) acceptNet(resp http.ResponseWriter, req *http.Request) ([][]byte, error) {
+	// Checking websocket version
+	if !supportedVersion(s2b(req.Header.Get(b2s(wsHeaderVersion)))) {
+		resp.WriteHeader(http.StatusBadRequest)
+		io.WriteString(resp, "Versions not supported")
+		return nil, ErrVersionNotSupported
+	}
+
+	if u.UpgradeNetHandler != nil {
+		w := &netResponseWriter{ResponseWriter: resp}
+		if !u.UpgradeNetHandler(w, req) {
+			if !w.written {
+				http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			}
+			return nil, ErrUpgradeRejected
+		}
+	}
+
+	return splitProtocols(s2b(req.Header.Get(b2s(wsHeaderProtocol)))), nil
+}
+
+// supportedVersion reports whether the websocket version is supported.
+func supportedVersion(version []byte) bool {
+	for i := range supportedVersions {
+		if bytes.Contains(supportedVersions[i], version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitProtocols splits the value of the Sec-WebSocket-Protocol header.
+func splitProtocols(h []byte) [][]byte {
+	return bytes.Split(h, commaString) // TODO: Reduce allocations. Do not split. Use IndexByte
+}
+
+// newNetConn returns a Conn upgraded from a net/http request.
+func newNetConn(c net.Conn, r io.Reader, req *http.Request, proto string) *Conn {
+	conn := acquireConn(c, r)
+	conn.ctx = req.Context()
+	conn.header = netRequestHeader(req)
+	conn.tlsState = req.TLS
+	conn.proto = proto
+
+	return conn
+}
+
+// netResponseWriter tracks whether the UpgradeNetHandler
+// already wrote a response.
+type netResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *netResponseWriter) WriteHeader(statusCode int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *netResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (w *netResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func prepareOrigin(b []byte, uri *fasthttp.URI) []byte {
 	b = append(b[:0], uri.Scheme()...)
 	b = append(b, "://"...)
@@ -68,6 +487,15 @@ func appendDecode(enc *b64.Encoding, dst, src []byte) ([]byte, error) {
 	return b[:len(dst)+n], err
 }
 
+// selectProtocol returns the subprotocol selected among the requested protos.
+func (u *Upgrader) selectProtocol(protos [][]byte) string {
+	if u.selectProto != nil {
+		return u.selectProto(protos)
+	}
+
+	return selectProtocol(protos, u.Protocols)
+}
+
 func selectProtocol(protos [][]byte, accepted []string) string {
 	if len(protos) == 0 {
 		return ""
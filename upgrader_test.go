@@ -2,7 +2,17 @@ package websocket
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
 )
 
 var (
@@ -55,3 +65,192 @@ func BenchmarkBase64Decoding(b *testing.B) {
 		}
 	}
 }
+
+func writeFragmented(t *testing.T, conn *Client, code Code, parts ...string) {
+	t.Helper()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for i, part := range parts {
+		fr.Reset()
+		if i == 0 {
+			fr.SetCode(code)
+		} else {
+			fr.SetContinuation()
+		}
+		if i == len(parts)-1 {
+			fr.SetFin()
+		}
+		fr.SetPayload([]byte(part))
+		fr.Mask()
+
+		if _, err := conn.WriteFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testUpgraderConn(t *testing.T, conn *Client, done <-chan error) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFragmented(t, conn, CodeText, "Hello", " ", "world")
+
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload([]byte("ping"))
+	fr.Mask()
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFragmented(t, conn, CodeBinary, "stream", "ed")
+
+	// echoed message
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if string(fr.Payload()) != "Hello world" {
+		t.Fatalf("unexpected echo: %s", fr.Payload())
+	}
+
+	// pong
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsPong() || string(fr.Payload()) != "ping" {
+		t.Fatalf("expected pong, got %s: %s", fr.Code(), fr.Payload())
+	}
+
+	fr.Reset()
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusGoAway)
+	fr.Mask()
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func upgraderHandler(done chan<- error) RequestHandler {
+	return func(c *Conn) {
+		done <- func() error {
+			ctx := context.Background()
+
+			code, b, err := c.ReadMessage(ctx)
+			if err != nil {
+				return err
+			}
+			if code != CodeText || string(b) != "Hello world" {
+				return fmt.Errorf("unexpected message %s: %s", code, b)
+			}
+
+			c.Write(b)
+
+			code, r, err := c.NextReader(ctx)
+			if err != nil {
+				return err
+			}
+			if b, err = io.ReadAll(r); err != nil {
+				return err
+			}
+			if code != CodeBinary || string(b) != "streamed" {
+				return fmt.Errorf("unexpected message %s: %s", code, b)
+			}
+
+			_, _, err = c.ReadMessage(ctx)
+			if e, ok := err.(Error); !ok || e.Status != StatusGoAway {
+				return fmt.Errorf("unexpected close error: %v", err)
+			}
+
+			return nil
+		}()
+	}
+}
+
+func TestUpgraderUpgrade(t *testing.T) {
+	done := make(chan error, 1)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	u := Upgrader{}
+	handler := upgraderHandler(done)
+
+	s := fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			if err := u.Upgrade(ctx, handler); err != nil {
+				done <- err
+			}
+		},
+	}
+	go s.Serve(ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := MakeClient(c, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	testUpgraderConn(t, conn, done)
+}
+
+func TestUpgraderUpgradeHTTP(t *testing.T) {
+	done := make(chan error, 1)
+
+	u := Upgrader{}
+	handler := upgraderHandler(done)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.UpgradeHTTP(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+
+		handler(c)
+	}))
+	defer s.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	testUpgraderConn(t, conn, done)
+}
+
+func TestUpgraderReject(t *testing.T) {
+	u := Upgrader{
+		Origin: "http://example.com",
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := u.UpgradeHTTP(w, r); err != ErrOriginNotAllowed {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}))
+	defer s.Close()
+
+	if _, err := Dial("ws" + strings.TrimPrefix(s.URL, "http")); err != ErrCannotUpgrade {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}